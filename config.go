@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alexflint/go-arg"
+)
+
+const (
+	userConfigDirName         = "shutter-pilot"
+	userConfigFileName        = "config.toml"
+	destinationConfigFileName = ".shutter-pilot.toml"
+	profilesKey               = "profiles"
+)
+
+// Settings of a config file. Keys are the long names of the command line
+// options, e.g. day-starts-at, plus sources and destination.
+type settings map[string]any
+
+var (
+	// Settings only taken from the command line. Deleting files has to be
+	// confirmed on every run, it is never switched on by a file.
+	userConfigDenied = []string{"confirm-delete"}
+	// The config of a destination is a file in the library, whoever can write to
+	// the library could otherwise make imports remove the sources.
+	destinationConfigDenied = []string{"confirm-delete", "move"}
+)
+
+// Returns the path of the config file in the user's config directory.
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, userConfigDirName, userConfigFileName), nil
+}
+
+// Reads a config file. A missing file has no settings.
+func readConfigFile(path string) (settings, error) {
+	var s settings
+	_, err := toml.DecodeFile(path, &s)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Returns the top level settings of the config file with the settings of the
+// profile on top, and whether the file has the profile.
+func (s settings) forProfile(profile string) (settings, bool, error) {
+	merged := make(settings)
+	for key, value := range s {
+		if key != profilesKey {
+			merged[key] = value
+		}
+	}
+	if profile == "" {
+		return merged, false, nil
+	}
+
+	profiles, ok := s[profilesKey].(map[string]any)
+	if !ok {
+		return merged, false, nil
+	}
+	profileSettings, ok := profiles[profile]
+	if !ok {
+		return merged, false, nil
+	}
+	values, ok := profileSettings.(map[string]any)
+	if !ok {
+		return nil, false, fmt.Errorf("profile %s is not a table", profile)
+	}
+
+	for key, value := range values {
+		merged[key] = value
+	}
+	return merged, true, nil
+}
+
+// Parses the command line on top of the settings from the config files.
+func parseArgs(a *args) (*arg.Parser, error) {
+	cmdline := withDefaultCommand(os.Args[1:])
+
+	parser, err := arg.NewParser(arg.Config{Program: filepath.Base(os.Args[0]), IgnoreDefault: true}, a)
+	if err != nil {
+		return nil, err
+	}
+
+	// The command, profile and destination pick which settings to load, so they
+	// are read before the settings are applied
+	var pre args
+	preParser, err := arg.NewParser(arg.Config{IgnoreDefault: true}, &pre)
+	if err != nil {
+		return nil, err
+	}
+	_ = preParser.Parse(cmdline)
+
+	names := preParser.SubcommandNames()
+	if len(names) > 0 && names[0] != "undo" {
+		// Fills in the defaults of the command, which the settings and then the
+		// command line are put on top of
+		defaultsParser, err := arg.NewParser(arg.Config{}, a)
+		if err != nil {
+			return nil, err
+		}
+		_ = defaultsParser.Parse(names)
+
+		err = loadConfig(defaultsParser.Subcommand(), pre.Profile, destinationOf(preParser.Subcommand()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parser.MustParse(cmdline)
+	return parser, nil
+}
+
+// Options of all commands, which can come before the command, and whether
+// they take a value.
+var globalOptions = map[string]bool{
+	"-p":           true,
+	"--profile":    true,
+	"--log-format": true,
+	"-q":           false,
+	"--quiet":      false,
+	"-v":           false,
+	"--verbose":    false,
+}
+
+// Returns the command line with the import command added when no command is
+// given, so the tool can still be run as 'shutter-pilot SOURCES DESTINATION'.
+func withDefaultCommand(cmdline []string) []string {
+	i := 0
+	for i < len(cmdline) {
+		name, _, hasValue := strings.Cut(cmdline[i], "=")
+		takesValue, ok := globalOptions[name]
+		if !ok {
+			break
+		}
+		if takesValue && !hasValue {
+			i += 2
+		} else {
+			i++
+		}
+	}
+	if i < len(cmdline) && (isCommand(cmdline[i]) || cmdline[i] == "-h" || cmdline[i] == "--help") {
+		return cmdline
+	}
+
+	return append([]string{"import"}, cmdline...)
+}
+
+func isCommand(name string) bool {
+	t := reflect.TypeOf(args{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("arg") == "subcommand:"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the destination given to a command, if it has one. The first library
+// given to dedupe stands in for the destination.
+func destinationOf(cmd any) string {
+	if cmd == nil {
+		return ""
+	}
+	v := reflect.ValueOf(cmd).Elem()
+	if roots := v.FieldByName("Roots"); roots.IsValid() {
+		first, _, _ := strings.Cut(roots.String(), ",")
+		return strings.TrimSpace(first)
+	}
+	field := v.FieldByName("Destination")
+	if !field.IsValid() {
+		return ""
+	}
+	return field.String()
+}
+
+// Loads the user config and the config of the destination directory into the
+// arguments of a command, later files and profiles overriding earlier ones.
+func loadConfig(cmd any, profile, destination string) error {
+	userConfig, err := userConfigPath()
+	if err != nil {
+		return err
+	}
+
+	profileFound := false
+	var checked []string
+	load := func(path string, denied []string) error {
+		checked = append(checked, path)
+		file, err := readConfigFile(path)
+		if err != nil || file == nil {
+			return err
+		}
+
+		s, found, err := file.forProfile(profile)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		profileFound = profileFound || found
+
+		err = applySettings(cmd, s, denied)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		return nil
+	}
+
+	err = load(userConfig, userConfigDenied)
+	if err != nil {
+		return err
+	}
+
+	// The destination can come from the command line or the user config
+	if destination == "" {
+		destination = destinationOf(cmd)
+	}
+	if destination != "" {
+		err = load(filepath.Join(destination, destinationConfigFileName), destinationConfigDenied)
+		if err != nil {
+			return err
+		}
+	}
+
+	if profile != "" && !profileFound {
+		return fmt.Errorf("profile %s not found in %s", profile, strings.Join(checked, " or "))
+	}
+
+	return nil
+}
+
+// Sets the fields of the arguments of a command from the settings, matching
+// keys to the long names of the options. Settings of other commands are left
+// out, so a config file can hold the settings of all commands. Denied settings
+// are refused, they have to be given on the command line.
+func applySettings(cmd any, s settings, denied []string) error {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	v := reflect.ValueOf(cmd).Elem()
+	for _, key := range keys {
+		if slices.Contains(denied, key) {
+			return fmt.Errorf("%s can't be set in this config file, give it on the command line", key)
+		}
+
+		field, ok := settingField(v, key)
+		if !ok {
+			if !isSetting(key) {
+				return fmt.Errorf("unknown setting: %s", key)
+			}
+			continue
+		}
+
+		err := setField(field, s[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Reports whether any command reads the setting.
+func isSetting(key string) bool {
+	for _, cmd := range []any{&importArgs{}, &planArgs{}, &applyArgs{}, &verifyArgs{}, &resumeArgs{}, &watchArgs{}, &dedupeArgs{}, &statsArgs{}} {
+		if _, ok := settingField(reflect.ValueOf(cmd).Elem(), key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func settingField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			field, ok := settingField(v.Field(i), key)
+			if ok {
+				return field, true
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		name := strings.ToLower(f.Name)
+		for _, part := range strings.Split(f.Tag.Get("arg"), ",") {
+			if strings.HasPrefix(part, "--") {
+				name = strings.TrimPrefix(part, "--")
+			}
+		}
+
+		if name == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func setField(field reflect.Value, value any) error {
+	switch field.Kind() {
+	case reflect.String:
+		switch value := value.(type) {
+		case string:
+			field.SetString(value)
+		case []any:
+			// Lists such as sources or filter are comma separated on the command line
+			var items []string
+			for _, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("expected a list of strings, got %v", value)
+				}
+				items = append(items, s)
+			}
+			field.SetString(strings.Join(items, ","))
+		case time.Time:
+			// Dates and times written without quotes, e.g. since = 2024-05-04
+			if value.Location().String() == "date-local" {
+				field.SetString(value.Format(time.DateOnly))
+			} else {
+				field.SetString(value.Format("2006-01-02T15:04:05"))
+			}
+		default:
+			return fmt.Errorf("expected a string, got %v", value)
+		}
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected true or false, got %v", value)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected a whole number, got %v", value)
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
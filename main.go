@@ -1,32 +1,233 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/andrius-ordojan/shutter-pilot/workflow"
 )
 
-var allowedFileTypes = []string{"jpg", "raf", "mov"}
+var allowedFileTypes = []string{"jpg", "raf", "mov", "mp4"}
+
+var allowedConflictStrategies = []workflow.ConflictStrategy{
+	workflow.ConflictManual,
+	workflow.ConflictKeepPlaced,
+	workflow.ConflictKeepOldest,
+	workflow.ConflictHardlink,
+}
+
+var allowedDuplicateDisposals = []workflow.DuplicateDisposal{
+	workflow.DisposeQuarantine,
+	workflow.DisposeDelete,
+}
+
+var allowedSourceDuplicateDisposals = []workflow.DuplicateDisposal{
+	workflow.DisposeKeep,
+	workflow.DisposeQuarantine,
+	workflow.DisposeDelete,
+}
+
+var allowedDedupeActions = []workflow.DedupeAction{
+	workflow.DedupeList,
+	workflow.DedupeLink,
+	workflow.DedupeQuarantine,
+	workflow.DedupeDelete,
+}
+
+var allowedKeeperRules = []workflow.KeeperRule{
+	workflow.KeepPlaced,
+	workflow.KeepOldest,
+	workflow.KeepFirstRoot,
+}
 
 type args struct {
-	Sources     string `arg:"positional,required" help:"source directories for media. Provide as a comma-separated list, e.g., /path/1,/path2/"`
-	Destination string `arg:"positional,required" help:"destination directory for orginised media"`
-	Filter      string `arg:"-f,--filter" help:"Filter by file types (allowed: jpg, raf, mov). Provide as a comma-separated list, e.g., -f jpg,mov"`
+	Import    *importArgs `arg:"subcommand:import" help:"organises media from the sources into the destination, used when no command is given"`
+	Plan      *planArgs   `arg:"subcommand:plan" help:"shows what importing would do without modifying the file system"`
+	Apply     *applyArgs  `arg:"subcommand:apply" help:"applies a plan saved by the plan command"`
+	Verify    *verifyArgs `arg:"subcommand:verify" help:"checks that the files runs placed in the destination are unchanged"`
+	Resume    *resumeArgs `arg:"subcommand:resume" help:"continues applying the plan of an interrupted run in the destination directory"`
+	Undo      *undoArgs   `arg:"subcommand:undo" help:"reverses the changes recorded in the journal of an earlier run"`
+	Watch     *watchArgs  `arg:"subcommand:watch" help:"imports the media of every card that is mounted while it runs"`
+	Dedupe    *dedupeArgs `arg:"subcommand:dedupe" help:"finds copies of the same media in libraries and removes the ones that are not kept"`
+	Stats     *statsArgs  `arg:"subcommand:stats" help:"reports what a library holds and the files in it that need attention"`
+	Profile   string      `arg:"-p,--profile" help:"named profile from the config file to use, e.g. --profile fuji-card"`
+	LogFormat string      `arg:"--log-format" default:"text" help:"format of the output, json prints every event as an object on its own line (allowed: text, json)"`
+	Quiet     bool        `arg:"-q,--quiet" default:"false" help:"only prints warnings"`
+	Verbose   bool        `arg:"-v,--verbose" default:"false" help:"also prints every file that is scanned"`
+}
+
+func (args) Description() string {
+	return "Compares media files in source directories with destination directory and organises them"
+}
+
+func (args) Epilogue() string {
+	return "When no command is given, import is used, e.g. 'shutter-pilot SOURCES DESTINATION'"
+}
+
+// Options shared by the commands that build a plan.
+type planOptions struct {
+	Sources     string `arg:"positional" help:"source directories for media, card:/path for the root of a memory card, sftp://user@host/path for one on a server or s3://bucket/path for one in a bucket. Provide as a comma-separated list, e.g., /path/1,/path2/"`
+	Destination string `arg:"positional" help:"destination directory for orginised media, sftp://user@host/path for one on a server or s3://bucket/path for one in a bucket"`
+	organiseOptions
+}
+
+// Options that decide how media is organised, shared by the commands that
+// build a plan and the watch command.
+type organiseOptions struct {
+	selectOptions
+	Since       string `arg:"--since" help:"only organises source files captured on or after this day, e.g. --since 2024-05-04. A time can follow the day, e.g. 2024-05-04T18:00"`
+	Until       string `arg:"--until" help:"only organises source files captured on or before this day, e.g. --until 2024-05-05. A time can follow the day, captures from then on are left out"`
+	Camera      string `arg:"--camera" help:"only organises source files captured with these cameras, matched against any part of the model. Videos are left out. Provide as a comma-separated list, e.g., --camera X-T4,X100V"`
+	DedupeLinks bool   `arg:"--dedupe-hardlinks" default:"false" help:"counts hard links to the same file in the destination once instead of reporting them as conflicts"`
 	MoveMode    bool   `arg:"-m,--move" default:"false" help:"moves files instead of copying"`
-	DryRun      bool   `arg:"-d,--dryrun" default:"false" help:"does not modify file system"`
+	layoutOptions
+	Conflicts  string `arg:"--conflicts" default:"manual" help:"how to resolve duplicate files in the destination (allowed: manual, keep-placed, keep-oldest, hardlink)"`
+	Duplicates string `arg:"--duplicates" default:"quarantine" help:"what to do with duplicates that are not kept when resolving conflicts (allowed: quarantine, delete)"`
+	SourceDups string `arg:"--source-duplicates" default:"keep" help:"what to do with source files that have the same contents as another source file once it is imported, only in move mode (allowed: keep, quarantine, delete)"`
+	scanOptions
+}
+
+// Options that pick the files a scan reads, shared by every command that scans.
+type selectOptions struct {
+	Filter      string `arg:"-f,--filter" help:"Filter by file types (allowed: jpg, raf, mov, mp4). Provide as a comma-separated list, e.g., -f jpg,mov"`
+	Exclude     string `arg:"--exclude" help:"files and directories to leave out of scans, on top of hidden ones and the trash, system and thumbnail directories of NAS and Lightroom. Provide as a comma-separated list of glob patterns, e.g., --exclude '*_edit.jpg,exports/*'"`
+	Include     string `arg:"--include" help:"only scans the files that match these glob patterns. Provide as a comma-separated list, e.g., --include 'DSCF*'"`
+	FollowLinks bool   `arg:"--follow-symlinks" default:"false" help:"scans the directories symbolic links point to, links back to a directory that is being scanned are skipped"`
+}
+
+// Options that tell where media is placed in a library.
+type layoutOptions struct {
 	NoSooc      bool   `arg:"-s,--nosooc" default:"false" help:"Does no place jpg photos under sooc directory, but next to raw files"`
+	DayStartsAt string `arg:"--day-starts-at" help:"time of day (HH:MM) when a new day begins. Media captured before it is filed under the previous day, e.g. --day-starts-at 04:00"`
 }
 
-func (args) Description() string {
+// Options that limit how much is read at the same time while scanning.
+type scanOptions struct {
+	ScanWorkers int    `arg:"--scan-workers" default:"4" help:"number of directories listed at the same time while scanning"`
+	HashWorkers int    `arg:"--hash-workers" default:"0" help:"number of files read at the same time while scanning, 0 for twice the number of CPUs"`
+	RootWorkers string `arg:"--root-workers" help:"number of directories listed and files read at the same time in a single source or destination directory. Provide as a comma-separated list, e.g., /mnt/nas=2,/media/card=8"`
+	Bandwidth   string `arg:"--bandwidth" help:"maximum amount of data read per second while scanning, e.g. 50MB. Units: B, KB, MB, GB"`
+}
+
+// Options shared by the commands that apply a plan.
+type applyOptions struct {
+	ApplyWorkers  int    `arg:"--apply-workers" default:"4" help:"number of files moved or copied at the same time"`
+	DeviceWorkers int    `arg:"--device-workers" default:"1" help:"number of files read from or written to the same disk or card at the same time, 0 for no limit"`
+	SpaceMargin   string `arg:"--space-margin" default:"1GB" help:"free space that should be left at the destination after applying the plan, less gives a warning. Units: B, KB, MB, GB"`
+}
+
+type importArgs struct {
+	planOptions
+	DryRun        bool `arg:"-d,--dryrun" default:"false" help:"does not modify file system"`
+	ConfirmDelete bool `arg:"--confirm-delete" default:"false" help:"allows the plan to delete files"`
+	Interactive   bool `arg:"-i,--interactive" default:"false" help:"review conflicts before the plan is applied and choose which files to keep"`
+	ReviewAll     bool `arg:"--review-all" default:"false" help:"when reviewing interactively, also review every move and copy"`
+	Resume        bool `arg:"--resume" default:"false" help:"same as the resume command, kept for older scripts"`
+	applyOptions
+}
+
+func (importArgs) Description() string {
 	return "Compares media files in source directories with destination directory and organises them"
 }
 
+type planArgs struct {
+	planOptions
+	Save string `arg:"--save" help:"file to save the plan to, so the apply command can apply it later"`
+}
+
+func (planArgs) Description() string {
+	return "Compares media files in source directories with destination directory and shows the actions needed to organise them"
+}
+
+type applyArgs struct {
+	Plan          string `arg:"positional" help:"plan saved with plan --save"`
+	ConfirmDelete bool   `arg:"--confirm-delete" default:"false" help:"allows the plan to delete files"`
+	applyOptions
+}
+
+func (applyArgs) Description() string {
+	return "Applies a plan saved by the plan command without scanning the sources and destination again, as long as none of its files changed since"
+}
+
+type verifyArgs struct {
+	Destination string `arg:"positional" help:"destination directory to verify"`
+}
+
+func (verifyArgs) Description() string {
+	return "Fingerprints the files earlier runs placed in the destination directory again and reports the ones that are missing or no longer match the fingerprint they were placed with"
+}
+
+type resumeArgs struct {
+	Destination string `arg:"positional" help:"destination directory of the interrupted run"`
+	applyOptions
+}
+
+func (resumeArgs) Description() string {
+	return "Continues applying the plan of an interrupted run without scanning the sources and destination again"
+}
+
+type undoArgs struct {
+	Journal string `arg:"positional,required" help:"journal of the run to reverse, found under .shutter-pilot/journal in the destination directory"`
+}
+
+func (undoArgs) Description() string {
+	return "Moves files back and removes copies made by an earlier run, as long as their contents are unchanged"
+}
+
+type watchArgs struct {
+	Destination string `arg:"positional" help:"destination directory for orginised media, sftp://user@host/path for one on a server or s3://bucket/path for one in a bucket"`
+	organiseOptions
+	Mounts        string `arg:"--mounts" help:"directories cards are mounted in, /media/$USER and /run/media/$USER when not given. Provide as a comma-separated list, e.g., /media/me,/mnt"`
+	Confirm       bool   `arg:"--confirm" default:"false" help:"shows the plan of each card and asks before applying it"`
+	ConfirmDelete bool   `arg:"--confirm-delete" default:"false" help:"allows the plan to delete files"`
+	applyOptions
+}
+
+func (watchArgs) Description() string {
+	return "Waits for cards with a DCIM directory to be mounted and organises the media on each of them into the destination directory"
+}
+
+type dedupeArgs struct {
+	Roots  string `arg:"positional" help:"library directories to look for duplicates in, copies are found across all of them. Provide as a comma-separated list, e.g., /photos,/mnt/nas/photos"`
+	Action string `arg:"--action" default:"list" help:"what happens to the copies that are not kept, link replaces them with hard links to the kept copy (allowed: list, link, quarantine, delete)"`
+	Keep   string `arg:"--keep" default:"placed" help:"copy of each set that is kept: the one at its organised path, the oldest or one in the library listed first (allowed: placed, oldest, first-root)"`
+	selectOptions
+	layoutOptions
+	scanOptions
+	DryRun        bool `arg:"-d,--dryrun" default:"false" help:"does not modify file system"`
+	ConfirmDelete bool `arg:"--confirm-delete" default:"false" help:"allows the plan to delete files"`
+	applyOptions
+}
+
+func (dedupeArgs) Description() string {
+	return "Lists files with the same contents in library directories with the space they take up, and links, quarantines or deletes all copies but one"
+}
+
+type statsArgs struct {
+	Destination string `arg:"positional" help:"library directory to report on, sftp://user@host/path for one on a server or s3://bucket/path for one in a bucket"`
+	LargestDays int    `arg:"--largest-days" default:"10" help:"number of days listed among the largest ones"`
+	selectOptions
+	layoutOptions
+	scanOptions
+}
+
+func (statsArgs) Description() string {
+	return "Counts the files and bytes of a library by year, month, media type, camera and lens, and lists the files that are not in their organised place or are missing a RAW/JPG partner"
+}
+
 func isValidFileType(ft string) bool {
 	ft = strings.ToLower(ft)
 	for _, allowed := range allowedFileTypes {
@@ -79,31 +280,554 @@ func validateSources(sources string) ([]string, error) {
 	return parseCommaSeperatedArg(sources)
 }
 
-func run() error {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	defer cancel()
+func validatePatterns(patterns string) ([]string, error) {
+	if patterns == "" {
+		return nil, nil
+	}
 
-	var args args
-	parser := arg.MustParse(&args)
+	parsedPatterns, err := parseCommaSeperatedArg(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range parsedPatterns {
+		if workflow.ValidatePattern(p) != nil {
+			return nil, fmt.Errorf("invalid pattern: %s. Expected a glob pattern, e.g. *.jpg", p)
+		}
+	}
+
+	return parsedPatterns, nil
+}
+
+func validateDayStartsAt(dayStartsAt string) (time.Duration, error) {
+	if dayStartsAt == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", strings.TrimSpace(dayStartsAt))
+	if err != nil {
+		return 0, fmt.Errorf("invalid day start: %s. Expected time of day in HH:MM format, e.g. 04:00", dayStartsAt)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Dates and times --since and --until take, in local time
+var captureTimeLayouts = []string{time.DateOnly, "2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// Returns the start and end of the captures to organise. Days are whole days,
+// which start at dayStartsAt like the directories media is filed under, and a
+// day given to until is included.
+func validateCaptureRange(since, until string, dayStartsAt time.Duration) (time.Time, time.Time, error) {
+	start, err := parseCaptureTime(since, dayStartsAt, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := parseCaptureTime(until, dayStartsAt, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid capture range: %s is not before %s", since, until)
+	}
+	return start, end, nil
+}
+
+func parseCaptureTime(value string, dayStartsAt time.Duration, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range captureTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == time.DateOnly {
+			if endOfDay {
+				t = t.AddDate(0, 0, 1)
+			}
+			t = t.Add(dayStartsAt)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid capture date: %s. Expected a day in YYYY-MM-DD format, optionally followed by a time, e.g. 2024-05-04 or 2024-05-04T18:00", value)
+}
+
+func validateCameras(cameras string) ([]string, error) {
+	if cameras == "" {
+		return nil, nil
+	}
+
+	return parseCommaSeperatedArg(cameras)
+}
+
+func validateApplyLimits(workers, perDevice int, spaceMargin string) (workflow.ApplyLimits, error) {
+	if workers < 1 {
+		return workflow.ApplyLimits{}, fmt.Errorf("invalid number of apply workers: %d. At least one is needed", workers)
+	}
+	if perDevice < 0 {
+		return workflow.ApplyLimits{}, fmt.Errorf("invalid number of device workers: %d. Use 0 for no limit", perDevice)
+	}
+
+	var margin int64
+	if spaceMargin != "" {
+		var err error
+		margin, err = parseSize(spaceMargin)
+		if err != nil {
+			return workflow.ApplyLimits{}, fmt.Errorf("invalid space margin: %s. Expected an amount of data, e.g. 1GB", spaceMargin)
+		}
+	}
+
+	return workflow.ApplyLimits{Workers: workers, PerDevice: perDevice, SpaceMargin: margin}, nil
+}
+
+func validateScanLimits(scanWorkers, hashWorkers int, rootWorkers, bandwidth string, roots []string) (workflow.ScanLimits, error) {
+	if scanWorkers < 1 {
+		return workflow.ScanLimits{}, fmt.Errorf("invalid number of scan workers: %d. At least one is needed", scanWorkers)
+	}
+	if hashWorkers < 0 {
+		return workflow.ScanLimits{}, fmt.Errorf("invalid number of hash workers: %d. Use 0 for twice the number of CPUs", hashWorkers)
+	}
+
+	limits := workflow.ScanLimits{ScanWorkers: scanWorkers, HashWorkers: hashWorkers}
+
+	if rootWorkers != "" {
+		entries, err := parseCommaSeperatedArg(rootWorkers)
+		if err != nil {
+			return workflow.ScanLimits{}, err
+		}
+
+		limits.RootWorkers = make(map[string]int)
+		for _, entry := range entries {
+			sep := strings.LastIndex(entry, "=")
+			if sep == -1 {
+				return workflow.ScanLimits{}, fmt.Errorf("invalid root workers: %s. Expected PATH=WORKERS, e.g. /mnt/nas=2", entry)
+			}
+
+			root := strings.TrimSpace(entry[:sep])
+			workers, err := strconv.Atoi(strings.TrimSpace(entry[sep+1:]))
+			if err != nil || workers < 1 {
+				return workflow.ScanLimits{}, fmt.Errorf("invalid root workers: %s. At least one worker is needed", entry)
+			}
+			if !slices.ContainsFunc(roots, func(r string) bool { return filepath.Clean(r) == filepath.Clean(root) }) {
+				return workflow.ScanLimits{}, fmt.Errorf("invalid root workers: %s is not a source or destination directory", root)
+			}
+
+			limits.RootWorkers[root] = workers
+		}
+	}
+
+	if bandwidth != "" {
+		bytesPerSecond, err := parseSize(bandwidth)
+		if err != nil || bytesPerSecond == 0 {
+			return workflow.ScanLimits{}, fmt.Errorf("invalid bandwidth: %s. Expected an amount of data, e.g. 50MB", bandwidth)
+		}
+		limits.BytesPerSecond = bytesPerSecond
+	}
+
+	return limits, nil
+}
+
+// Parses an amount of data such as 512KB or 1.5GB into bytes.
+func parseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiplier = u.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, errors.New("size can not be negative")
+	}
+	return int64(value * multiplier), nil
+}
+
+func validateConflictPolicy(strategy, disposal string) (workflow.ConflictPolicy, error) {
+	s := workflow.ConflictStrategy(strings.ToLower(strings.TrimSpace(strategy)))
+	if !slices.Contains(allowedConflictStrategies, s) {
+		return workflow.ConflictPolicy{}, fmt.Errorf("invalid conflict strategy: %s. Allowed strategies are: %s", strategy, joinAllowed(allowedConflictStrategies))
+	}
+
+	d := workflow.DuplicateDisposal(strings.ToLower(strings.TrimSpace(disposal)))
+	if !slices.Contains(allowedDuplicateDisposals, d) {
+		return workflow.ConflictPolicy{}, fmt.Errorf("invalid duplicate handling: %s. Allowed values are: %s", disposal, joinAllowed(allowedDuplicateDisposals))
+	}
+
+	return workflow.ConflictPolicy{Strategy: s, Disposal: d}, nil
+}
+
+func validateSourceDuplicates(disposal string, moveMode bool) (workflow.DuplicateDisposal, error) {
+	d := workflow.DuplicateDisposal(strings.ToLower(strings.TrimSpace(disposal)))
+	if !slices.Contains(allowedSourceDuplicateDisposals, d) {
+		return "", fmt.Errorf("invalid source duplicate handling: %s. Allowed values are: %s", disposal, joinAllowed(allowedSourceDuplicateDisposals))
+	}
+
+	if d != workflow.DisposeKeep && !moveMode {
+		return "", errors.New("source duplicates can only be removed in move mode")
+	}
+
+	return d, nil
+}
+
+func validateDedupeAction(action string) (workflow.DedupeAction, error) {
+	a := workflow.DedupeAction(strings.ToLower(strings.TrimSpace(action)))
+	if !slices.Contains(allowedDedupeActions, a) {
+		return "", fmt.Errorf("invalid dedupe action: %s. Allowed values are: %s", action, joinAllowed(allowedDedupeActions))
+	}
+	return a, nil
+}
+
+func validateKeeperRule(rule string) (workflow.KeeperRule, error) {
+	r := workflow.KeeperRule(strings.ToLower(strings.TrimSpace(rule)))
+	if !slices.Contains(allowedKeeperRules, r) {
+		return "", fmt.Errorf("invalid copy to keep: %s. Allowed values are: %s", rule, joinAllowed(allowedKeeperRules))
+	}
+	return r, nil
+}
+
+func joinAllowed[T ~string](allowed []T) string {
+	values := make([]string, 0, len(allowed))
+	for _, a := range allowed {
+		values = append(values, string(a))
+	}
+	return strings.Join(values, ", ")
+}
+
+// Prints the usage of the command that was run together with the error and
+// exits.
+func fail(parser *arg.Parser, msg string) {
+	parser.FailSubcommand(msg, parser.SubcommandNames()...)
+}
+
+// Validates the options shared by the commands that build a plan.
+func validatePlanOptions(parser *arg.Parser, opts planOptions) workflow.Options {
+	if opts.Destination == "" {
+		fail(parser, "destination is required either as an argument or in the config file")
+	}
+	if opts.Sources == "" {
+		fail(parser, "sources are required either as an argument or in the config file")
+	}
+
+	filterByFiletypes, err := validateFileTypes(opts.Filter)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	sourcesList, err := validateSources(opts.Sources)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	exclude, err := validatePatterns(opts.Exclude)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	include, err := validatePatterns(opts.Include)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	dayStartsAt, err := validateDayStartsAt(opts.DayStartsAt)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	since, until, err := validateCaptureRange(opts.Since, opts.Until, dayStartsAt)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	cameras, err := validateCameras(opts.Camera)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	conflictPolicy, err := validateConflictPolicy(opts.Conflicts, opts.Duplicates)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	sourceDuplicates, err := validateSourceDuplicates(opts.SourceDups, opts.MoveMode)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	scanLimits, err := validateScanLimits(opts.ScanWorkers, opts.HashWorkers, opts.RootWorkers, opts.Bandwidth, append(sourcesList, opts.Destination))
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	return workflow.Options{
+		Sources:          sourcesList,
+		Destination:      opts.Destination,
+		MoveMode:         opts.MoveMode,
+		Filter:           filterByFiletypes,
+		NoSooc:           opts.NoSooc,
+		DayStartsAt:      dayStartsAt,
+		Since:            since,
+		Until:            until,
+		Cameras:          cameras,
+		Exclude:          exclude,
+		Include:          include,
+		FollowSymlinks:   opts.FollowLinks,
+		DedupeHardLinks:  opts.DedupeLinks,
+		ConflictPolicy:   conflictPolicy,
+		SourceDuplicates: sourceDuplicates,
+		ScanLimits:       scanLimits,
+	}
+}
+
+func runDedupe(ctx context.Context, parser *arg.Parser, args *dedupeArgs, out output) error {
+	if args.Roots == "" {
+		fail(parser, "library directories are required either as an argument or in the config file")
+	}
+
+	roots, err := parseCommaSeperatedArg(args.Roots)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	action, err := validateDedupeAction(args.Action)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	keep, err := validateKeeperRule(args.Keep)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	filterByFiletypes, err := validateFileTypes(args.Filter)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	exclude, err := validatePatterns(args.Exclude)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	include, err := validatePatterns(args.Include)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	dayStartsAt, err := validateDayStartsAt(args.DayStartsAt)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	scanLimits, err := validateScanLimits(args.ScanWorkers, args.HashWorkers, args.RootWorkers, args.Bandwidth, roots)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	applyLimits, err := validateApplyLimits(args.ApplyWorkers, args.DeviceWorkers, args.SpaceMargin)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	fsys, err := openStorage(roots...)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	plan, err := workflow.NewDeduper(workflow.DedupeOptions{
+		Roots:          roots,
+		Action:         action,
+		Keep:           keep,
+		Filter:         filterByFiletypes,
+		Exclude:        exclude,
+		Include:        include,
+		FollowSymlinks: args.FollowLinks,
+		NoSooc:         args.NoSooc,
+		DayStartsAt:    dayStartsAt,
+		ScanLimits:     scanLimits,
+		ApplyLimits:    applyLimits,
+		AllowDelete:    args.ConfirmDelete,
+		Events:         out.sink(),
+		FS:             fsys,
+	}).Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if action == workflow.DedupeList || args.DryRun {
+		return nil
+	}
+
+	err = plan.Apply(ctx)
+	if err != nil {
+		// Nothing was changed, the blocked event tells why
+		if errors.Is(err, workflow.ErrBlocked) {
+			return nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return errors.New("application shutting down gracefully")
+		}
+
+		return fmt.Errorf("error while applying plan: %w", err)
+	}
+
+	return nil
+}
+
+func runStats(ctx context.Context, parser *arg.Parser, args *statsArgs, out output) error {
+	if args.Destination == "" {
+		fail(parser, "destination is required either as an argument or in the config file")
+	}
+
+	if args.LargestDays < 0 {
+		fail(parser, fmt.Sprintf("invalid number of largest days: %d. It can't be negative", args.LargestDays))
+	}
 
 	filterByFiletypes, err := validateFileTypes(args.Filter)
 	if err != nil {
-		parser.Fail(err.Error())
+		fail(parser, err.Error())
+	}
+
+	exclude, err := validatePatterns(args.Exclude)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	include, err := validatePatterns(args.Include)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	dayStartsAt, err := validateDayStartsAt(args.DayStartsAt)
+	if err != nil {
+		fail(parser, err.Error())
 	}
 
-	sourcesList, err := validateSources(args.Sources)
+	scanLimits, err := validateScanLimits(args.ScanWorkers, args.HashWorkers, args.RootWorkers, args.Bandwidth, []string{args.Destination})
 	if err != nil {
-		parser.Fail(err.Error())
+		fail(parser, err.Error())
 	}
 
-	plan, err := workflow.CreatePlan(ctx, sourcesList, args.Destination, args.MoveMode, filterByFiletypes, args.NoSooc)
+	fsys, err := openStorage(args.Destination)
 	if err != nil {
 		return err
 	}
+	defer fsys.Close()
+
+	_, err = workflow.CollectStats(ctx, workflow.StatsOptions{
+		Destination:    args.Destination,
+		Filter:         filterByFiletypes,
+		Exclude:        exclude,
+		Include:        include,
+		FollowSymlinks: args.FollowLinks,
+		NoSooc:         args.NoSooc,
+		DayStartsAt:    dayStartsAt,
+		ScanLimits:     scanLimits,
+		LargestDays:    args.LargestDays,
+		Events:         out.sink(),
+		FS:             fsys,
+	})
+	return err
+}
+
+// Returns the directories cards are mounted in when none are given, /Volumes on
+// macOS and the ones udisks mounts them in for the current user elsewhere.
+func validateMounts(mounts string) ([]string, error) {
+	if mounts != "" {
+		return parseCommaSeperatedArg(mounts)
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"/Volumes"}, nil
+	case "windows":
+		return nil, errors.New("mount directories are required on Windows, e.g. --mounts E:\\")
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current user for the mount directories: %w", err)
+	}
+	return []string{filepath.Join("/media", u.Username), filepath.Join("/run/media", u.Username)}, nil
+}
+
+func runImport(ctx context.Context, parser *arg.Parser, args *importArgs, out output) error {
+	if args.Resume {
+		if args.DryRun || args.Interactive {
+			fail(parser, "--resume can not be used together with --dryrun or --interactive")
+		}
+
+		return runResume(ctx, parser, &resumeArgs{Destination: args.Destination, applyOptions: args.applyOptions}, out)
+	}
+
+	applyLimits, err := validateApplyLimits(args.ApplyWorkers, args.DeviceWorkers, args.SpaceMargin)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	if args.ReviewAll && !args.Interactive {
+		fail(parser, "--review-all can only be used together with --interactive")
+	}
+	if args.Interactive && out.format != textFormat {
+		fail(parser, "--interactive can only be used with the text log format")
+	}
+
+	options := validatePlanOptions(parser, args.planOptions)
+	options.ApplyLimits = applyLimits
+	options.AllowDelete = args.ConfirmDelete
+	options.Events = out.sink()
+
+	fsys, err := openStorage(append(options.Sources, options.Destination)...)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+	options.FS = fsys
+
+	plan, err := workflow.NewPlanner(options).Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if args.Interactive {
+		err := plan.Review(ctx, os.Stdin, os.Stdout, args.ReviewAll)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return errors.New("application shutting down gracefully")
+			}
+
+			return fmt.Errorf("error while reviewing plan: %w", err)
+		}
+	}
 
 	if !args.DryRun {
 		err := plan.Apply(ctx)
 		if err != nil {
+			// Nothing was changed, the blocked event tells why
+			if errors.Is(err, workflow.ErrBlocked) {
+				return nil
+			}
 			if errors.Is(err, context.Canceled) {
 				return errors.New("application shutting down gracefully")
 			}
@@ -115,6 +839,316 @@ func run() error {
 	return nil
 }
 
+func runPlan(ctx context.Context, parser *arg.Parser, args *planArgs, out output) error {
+	options := validatePlanOptions(parser, args.planOptions)
+	options.Events = out.sink()
+
+	fsys, err := openStorage(append(options.Sources, options.Destination)...)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+	options.FS = fsys
+
+	plan, err := workflow.NewPlanner(options).Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if args.Save != "" {
+		f, err := os.Create(args.Save)
+		if err != nil {
+			return fmt.Errorf("failed to save plan: %w", err)
+		}
+		defer f.Close()
+
+		err = plan.Save(f)
+		if err != nil {
+			return fmt.Errorf("failed to save plan: %w", err)
+		}
+		return f.Close()
+	}
+
+	return nil
+}
+
+func runApply(ctx context.Context, parser *arg.Parser, args *applyArgs, out output) error {
+	if args.Plan == "" {
+		fail(parser, "plan is required, save one with plan --save")
+	}
+
+	applyLimits, err := validateApplyLimits(args.ApplyWorkers, args.DeviceWorkers, args.SpaceMargin)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	f, err := os.Open(args.Plan)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	saved, err := workflow.ReadPlanFile(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	fsys, err := openStorage(append(saved.Sources, saved.Destination)...)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	plan, err := workflow.LoadPlan(ctx, saved, workflow.Options{
+		ApplyLimits: applyLimits,
+		AllowDelete: args.ConfirmDelete,
+		Events:      out.sink(),
+		FS:          fsys,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = plan.Apply(ctx)
+	if err != nil {
+		// Nothing was changed, the blocked event tells why
+		if errors.Is(err, workflow.ErrBlocked) {
+			return nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return errors.New("application shutting down gracefully")
+		}
+
+		return fmt.Errorf("error while applying plan: %w", err)
+	}
+
+	return nil
+}
+
+func runVerify(ctx context.Context, parser *arg.Parser, args *verifyArgs, out output) error {
+	if args.Destination == "" {
+		fail(parser, "destination is required either as an argument or in the config file")
+	}
+
+	fsys, err := openStorage(args.Destination)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	summary, err := workflow.Verify(ctx, workflow.Options{Destination: args.Destination, FS: fsys, Events: out.sink()})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return errors.New("application shutting down gracefully")
+		}
+
+		return fmt.Errorf("error while verifying destination: %w", err)
+	}
+
+	// Missing files are only reported, later runs delete files without
+	// recording it
+	if summary.Damaged > 0 {
+		return fmt.Errorf("%d files are damaged", summary.Damaged)
+	}
+
+	return nil
+}
+
+func runResume(ctx context.Context, parser *arg.Parser, args *resumeArgs, out output) error {
+	if args.Destination == "" {
+		fail(parser, "destination is required either as an argument or in the config file")
+	}
+
+	applyLimits, err := validateApplyLimits(args.ApplyWorkers, args.DeviceWorkers, args.SpaceMargin)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	fsys, err := openStorage(args.Destination)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	err = workflow.Resume(ctx, workflow.Options{
+		Destination: args.Destination,
+		ApplyLimits: applyLimits,
+		FS:          fsys,
+		Events:      out.sink(),
+	})
+	if err != nil {
+		// Nothing was changed, the blocked event tells why
+		if errors.Is(err, workflow.ErrBlocked) {
+			return nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return errors.New("application shutting down gracefully")
+		}
+
+		return fmt.Errorf("error while resuming plan: %w", err)
+	}
+
+	return nil
+}
+
+func runUndo(ctx context.Context, args *undoArgs, out output) error {
+	fsys, err := openStorage(args.Journal)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	_, err = workflow.Undo(ctx, args.Journal, workflow.Options{FS: fsys, Events: out.sink()})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return errors.New("application shutting down gracefully")
+		}
+
+		return fmt.Errorf("error while undoing changes: %w", err)
+	}
+
+	return nil
+}
+
+func runWatch(ctx context.Context, parser *arg.Parser, args *watchArgs, out output) error {
+	if args.Confirm && out.format != textFormat {
+		fail(parser, "--confirm can only be used with the text log format")
+	}
+
+	applyLimits, err := validateApplyLimits(args.ApplyWorkers, args.DeviceWorkers, args.SpaceMargin)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	mounts, err := validateMounts(args.Mounts)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	// Cards are not known until they are mounted, so the mount directories
+	// stand in for the sources while the options are validated
+	options := validatePlanOptions(parser, planOptions{Sources: strings.Join(mounts, ","), Destination: args.Destination, organiseOptions: args.organiseOptions})
+	options.ApplyLimits = applyLimits
+	options.AllowDelete = args.ConfirmDelete
+	sink := out.sink()
+	options.Events = sink
+
+	fsys, err := openStorage(options.Destination)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+	options.FS = fsys
+
+	answers := readLines(os.Stdin)
+	interrupted := false
+	err = workflow.WatchCards(ctx, mounts, sink, func(ctx context.Context, dcim string) error {
+		cardOptions := options
+		// The whole card, video is kept outside of DCIM on some of them
+		cardOptions.Sources = []string{workflow.CardPrefix + filepath.Dir(dcim)}
+
+		plan, err := workflow.NewPlanner(cardOptions).Plan(ctx)
+		if err != nil {
+			return err
+		}
+
+		if args.Confirm {
+			ok, err := confirm(ctx, answers, fmt.Sprintf("Apply the plan for %s? [y/N]: ", dcim))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return workflow.ErrCardSkipped
+			}
+		}
+
+		err = plan.Apply(ctx)
+		if errors.Is(err, context.Canceled) {
+			interrupted = true
+		}
+		return err
+	})
+	if errors.Is(err, context.Canceled) {
+		if interrupted {
+			return errors.New("application shutting down gracefully")
+		}
+
+		// Watching ends when it is interrupted
+		return nil
+	}
+
+	return err
+}
+
+// Returns the lines read from the reader. They are read in the background so
+// waiting for an answer can be given up on once the context is cancelled.
+func readLines(r io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// Asks a yes or no question on stdout. Anything but yes counts as no.
+func confirm(ctx context.Context, answers <-chan string, question string) (bool, error) {
+	fmt.Print(question)
+
+	select {
+	case <-ctx.Done():
+		fmt.Println()
+		return false, ctx.Err()
+	case answer, ok := <-answers:
+		if !ok {
+			return false, errors.New("no answer, input is closed")
+		}
+
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+func run() error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	var args args
+	parser, err := parseArgs(&args)
+	if err != nil {
+		return err
+	}
+
+	out, err := validateOutput(args.LogFormat, args.Quiet, args.Verbose)
+	if err != nil {
+		fail(parser, err.Error())
+	}
+
+	switch {
+	case args.Plan != nil:
+		return runPlan(ctx, parser, args.Plan, out)
+	case args.Apply != nil:
+		return runApply(ctx, parser, args.Apply, out)
+	case args.Verify != nil:
+		return runVerify(ctx, parser, args.Verify, out)
+	case args.Resume != nil:
+		return runResume(ctx, parser, args.Resume, out)
+	case args.Undo != nil:
+		return runUndo(ctx, args.Undo, out)
+	case args.Watch != nil:
+		return runWatch(ctx, parser, args.Watch, out)
+	case args.Dedupe != nil:
+		return runDedupe(ctx, parser, args.Dedupe, out)
+	case args.Stats != nil:
+		return runStats(ctx, parser, args.Stats, out)
+	default:
+		return runImport(ctx, parser, args.Import, out)
+	}
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+	"github.com/andrius-ordojan/shutter-pilot/workflow"
+	"github.com/pkg/sftp"
 )
 
 type (
@@ -230,6 +244,30 @@ func runWithVolume(t *testing.T, silent bool, args ...string) error {
 	return nil
 }
 
+func withStdin(t *testing.T, input string) {
+	stdin, err := os.CreateTemp("", "tmp_stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(stdin.Name()) })
+
+	_, err = stdin.WriteString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stdin.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = originalStdin
+		stdin.Close()
+	})
+}
+
 func Test_ShouldSkip_WhenMediaExists(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
@@ -491,107 +529,273 @@ func Test_ShouldConflict_WhenDuplicateMediaExistsInDestination(t *testing.T) {
 	}
 }
 
-func Test_ShouldError_WhenDestinationFolderDoesNotExist(t *testing.T) {
-	sourceDir, err := os.MkdirTemp(".", "tmptest")
+func Test_ShouldQuarantineDuplicates_WhenKeepPlacedConflictStrategyIsSelected(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(destDir)
+	media.CopyTo(srcDir)
+	media.CopyToExpectedDestination()
+
+	err := runSilently(t, "app", "--conflicts", "keep-placed", srcDir, destDir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	defer os.RemoveAll(sourceDir)
 
-	err = runSilently(t, "app", sourceDir, "notExist")
-	if err == nil {
-		t.Fatalf("expected an error, but got nil")
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if !errors.Is(err, os.ErrNotExist) {
-		t.Errorf("expected error to be os.ErrNotExist, but got: %v", err)
+	err = media.CheckMissingAt(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(filepath.Join(destDir, ".shutter-pilot", "quarantine"))
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func Test_ShouldError_WhenSourceFolderDoesNotExist(t *testing.T) {
-	destDir, err := os.MkdirTemp(".", "tmptest")
+func Test_ShouldNotDeleteDuplicates_WhenDeleteIsNotConfirmed(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(destDir)
+	media.CopyToExpectedDestination()
+
+	err := runSilently(t, "app", "--conflicts", "keep-placed", "--duplicates", "delete", srcDir, destDir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	defer os.RemoveAll(destDir)
 
-	err = runSilently(t, "app", "notExist", destDir)
-	if err == nil {
-		t.Fatalf("expected an error, but got nil")
+	err = media.CheckExistsAt(destDir)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if !errors.Is(err, os.ErrNotExist) {
-		t.Errorf("expected error to be os.ErrNotExist, but got: %v", err)
+	err = runSilently(t, "app", "--conflicts", "keep-placed", "--duplicates", "delete", "--confirm-delete", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = media.CheckMissingAt(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func Test_ShouldNotMakeChanges_WhenDryrunIsOn(t *testing.T) {
+func Test_ShouldKeepSelectedFile_WhenConflictIsReviewedInteractively(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
 
-	for _, m := range validTestMediaFiles() {
-		m.SourceDir = srcDir
-		m.DestinationDir = destDir
-		m.CopyTo(srcDir)
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(destDir)
+	media.CopyToExpectedDestination()
+
+	// Conflicting files are listed by path, the copy in the destination root comes first
+	withStdin(t, "2\nq\n")
+
+	err := runSilently(t, "app", "--interactive", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err := runSilently(t, "app", "--dryrun", srcDir, destDir)
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckMissingAt(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(filepath.Join(destDir, ".shutter-pilot", "quarantine"))
 	if err != nil {
 		t.Fatal(err)
 	}
+}
 
-	for _, m := range validTestMediaFiles() {
-		err := m.CheckMissingAt(m.FullExpectedDestination())
-		if err != nil {
-			t.Fatal(err)
-		}
+func Test_ShouldNotMakeChanges_WhenConflictIsSkippedInteractively(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
 
-		err = m.CheckExistsAt(m.SourceDir)
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(destDir)
+	media.CopyToExpectedDestination()
+
+	withStdin(t, "s\n")
+
+	err := runSilently(t, "app", "--interactive", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ShouldKeepOriginal_WhenCopyIsDroppedDuringReview(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	err := fsys.WriteFile("/card/a.MOV", movData(captured, "a"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Review(context.Background(), strings.NewReader("d\n"), io.Discard, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fsys.Stat("/card/a.MOV")
+	if err != nil {
+		t.Errorf("expected the original to be kept: %v", err)
+	}
+	_, err = fsys.Stat(movDestination("/library", captured, "a.MOV"))
+	if err == nil {
+		t.Error("expected the dropped copy not to be made")
+	}
+}
+
+func Test_ShouldNeedConfirmDelete_WhenConflictCopiesAreDeletedDuringReview(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	for _, path := range []string{"/library/a.MOV", movDestination("/library", captured, "a.MOV")} {
+		err := fsys.WriteFile(path, movData(captured, "a"), captured)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
+	err := fsys.MkdirAll("/card", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keeps the organised file and deletes the other one
+	err = plan.Review(context.Background(), strings.NewReader("2\nd\n"), io.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if !errors.Is(err, workflow.ErrBlocked) {
+		t.Fatalf("expected the plan to be blocked, got %v", err)
+	}
+
+	_, err = fsys.Stat("/library/a.MOV")
+	if err != nil {
+		t.Errorf("expected the delete to wait for --confirm-delete: %v", err)
+	}
 }
 
-func Test_ShouldError_WhenMetadataNotPresentInPhoto(t *testing.T) {
+func Test_ShouldKeepSourceDuplicates_WhenMediaIsCopied(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
 
-	for _, m := range invalidTestMediaFiles() {
-		if m.Type != JpgFile {
-			continue
-		}
-		m.SourceDir = srcDir
-		m.DestinationDir = destDir
-		m.CopyTo(srcDir)
-	}
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(srcDir)
+	media.CopyTo(filepath.Join(srcDir, "subfolder"))
 
 	err := runSilently(t, "app", srcDir, destDir)
-	if err == nil {
-		t.Fatal("execution shuold fail because exif data does not exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(filepath.Join(srcDir, "subfolder"))
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func Test_ShouldError_WhenMetadataNotPresentInVideo(t *testing.T) {
+func Test_ShouldQuarantineSourceDuplicates_WhenMediaIsMoved(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
 
-	for _, m := range invalidTestMediaFiles() {
-		if m.Type != MovFile {
-			continue
-		}
-		m.SourceDir = srcDir
-		m.DestinationDir = destDir
-		m.CopyTo(srcDir)
+	media := testMediaFiles[0]
+	media.SourceDir = srcDir
+	media.DestinationDir = destDir
+	media.CopyTo(srcDir)
+	media.CopyTo(filepath.Join(srcDir, "subfolder"))
+
+	err := runSilently(t, "app", "--move", "--source-duplicates", "quarantine", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err := runSilently(t, "app", srcDir, destDir)
-	if err == nil {
-		t.Fatal("execution shuold fail because metadata does not exist")
+	err = media.CheckExistsAt(media.FullExpectedDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckMissingAt(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckMissingAt(filepath.Join(srcDir, "subfolder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = media.CheckExistsAt(filepath.Join(srcDir, ".shutter-pilot", "quarantine", "subfolder"))
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func Test_ShouldCopyCertainFiletypes_WhenFilterIsSelected(t *testing.T) {
+func findJournal(t *testing.T, destDir string) string {
+	journals, err := filepath.Glob(filepath.Join(destDir, ".shutter-pilot", "journal", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 1 {
+		t.Fatalf("expected 1 journal, but found %d", len(journals))
+	}
+	return journals[0]
+}
+
+func Test_ShouldRemoveCopies_WhenCopyIsUndone(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
 
@@ -601,45 +805,341 @@ func Test_ShouldCopyCertainFiletypes_WhenFilterIsSelected(t *testing.T) {
 		m.CopyTo(srcDir)
 	}
 
-	err := runSilently(t, "app", "-f", "jpg", srcDir, destDir)
+	err := runSilently(t, "app", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "undo", findJournal(t, destDir))
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	for _, m := range validTestMediaFiles() {
-		if m.Type == JpgFile {
-			err := m.CheckExistsAt(m.FullExpectedDestination())
-			if err != nil {
-				t.Fatal(err)
-			}
-		} else {
-			err := m.CheckMissingAt(m.FullExpectedDestination())
-			if err != nil {
-				t.Fatal(err)
-			}
+		err := m.CheckMissingAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.CheckExistsAt(m.SourceDir)
+		if err != nil {
+			t.Fatal(err)
 		}
 	}
 }
 
-func Test_ShouldNotUseSoocFolderForJpg_WhenNoSoocOptionIsSet(t *testing.T) {
+func Test_ShouldMoveFilesBack_WhenMoveIsUndone(t *testing.T) {
 	srcDir := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
 
 	for _, m := range validTestMediaFiles() {
 		m.SourceDir = srcDir
 		m.DestinationDir = destDir
-		m.CopyTo(srcDir)
+		m.CopyTo(filepath.Join(srcDir, "subfolder"))
 	}
 
-	err := runSilently(t, "app", "--nosooc", srcDir, destDir)
+	err := runSilently(t, "app", "--move", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "undo", findJournal(t, destDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckMissingAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.CheckExistsAt(filepath.Join(m.SourceDir, "subfolder"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldCompleteApply_WhenInterruptedRunIsResumed(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	// A directory in place of the file makes the copy fail part way through the plan
+	blocked := filepath.Join(validTestMediaFiles()[0].FullExpectedDestination(), validTestMediaFiles()[0].Name)
+	err := os.MkdirAll(blocked, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", srcDir, destDir)
+	if err == nil {
+		t.Fatal("execution should fail because destination is blocked")
+	}
+
+	err = os.Remove(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "--resume", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckExistsAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(destDir, ".shutter-pilot", "resume.jsonl"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed once the plan is applied")
+	}
+}
+
+func Test_ShouldError_WhenThereIsNothingToResume(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	err := runSilently(t, "app", "--resume", srcDir, destDir)
+	if err == nil {
+		t.Fatal("execution should fail because there is no interrupted run")
+	}
+}
+
+func Test_ShouldError_WhenDestinationFolderDoesNotExist(t *testing.T) {
+	sourceDir, err := os.MkdirTemp(".", "tmptest")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(sourceDir)
+
+	err = runSilently(t, "app", sourceDir, "notExist")
+	if err == nil {
+		t.Fatalf("expected an error, but got nil")
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error to be os.ErrNotExist, but got: %v", err)
+	}
+}
+
+func Test_ShouldError_WhenSourceFolderDoesNotExist(t *testing.T) {
+	destDir, err := os.MkdirTemp(".", "tmptest")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	err = runSilently(t, "app", "notExist", destDir)
+	if err == nil {
+		t.Fatalf("expected an error, but got nil")
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error to be os.ErrNotExist, but got: %v", err)
+	}
+}
+
+func Test_ShouldNotMakeChanges_WhenDryrunIsOn(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", "--dryrun", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckMissingAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.CheckExistsAt(m.SourceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldNotMakeChanges_WhenPlanCommandIsUsed(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", "plan", "--move", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckMissingAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.CheckExistsAt(m.SourceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldApplySavedPlan_WhenApplyCommandIsUsed(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	err := os.WriteFile(filepath.Join(srcDir, "a.MOV"), movData(captured, "a"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "plan", "--save", planFile, srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := movDestination(destDir, captured, "a.MOV")
+	if _, err := os.Stat(imported); err == nil {
+		t.Fatal("expected the plan command not to copy anything")
+	}
+
+	err = runSilently(t, "app", "apply", planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(imported); err != nil {
+		t.Fatalf("expected the saved plan to be applied: %v", err)
+	}
+
+	err = runSilently(t, "app", "verify", destDir)
+	if err != nil {
+		t.Fatalf("expected the copy to be verified: %v", err)
+	}
+
+	err = os.WriteFile(imported, movData(captured, "damaged"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runSilently(t, "app", "verify", destDir)
+	if err == nil {
+		t.Fatal("expected verify to fail for the damaged copy")
+	}
+}
+
+func Test_ShouldRefuseSavedPlan_WhenSourceChangedSinceItWasSaved(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	source := filepath.Join(srcDir, "a.MOV")
+	err := os.WriteFile(source, movData(captured, "a"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "plan", "--save", planFile, srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(source, movData(captured, "edited"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runSilently(t, "app", "apply", planFile)
+	if err == nil {
+		t.Fatal("expected an out of date plan to be refused")
+	}
+	if _, err := os.Stat(movDestination(destDir, captured, "a.MOV")); err == nil {
+		t.Error("expected nothing to be copied")
+	}
+}
+
+func Test_ShouldError_WhenMetadataNotPresentInPhoto(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range invalidTestMediaFiles() {
+		if m.Type != JpgFile {
+			continue
+		}
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", srcDir, destDir)
+	if err == nil {
+		t.Fatal("execution shuold fail because exif data does not exist")
+	}
+}
+
+func Test_ShouldError_WhenMetadataNotPresentInVideo(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range invalidTestMediaFiles() {
+		if m.Type != MovFile {
+			continue
+		}
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", srcDir, destDir)
+	if err == nil {
+		t.Fatal("execution shuold fail because metadata does not exist")
+	}
+}
+
+func Test_ShouldCopyCertainFiletypes_WhenFilterIsSelected(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", "-f", "jpg", srcDir, destDir)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	for _, m := range validTestMediaFiles() {
 		if m.Type == JpgFile {
-			expectedPath := filepath.Dir(m.FullExpectedDestination())
-			err := m.CheckExistsAt(expectedPath)
+			err := m.CheckExistsAt(m.FullExpectedDestination())
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			err := m.CheckMissingAt(m.FullExpectedDestination())
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -647,7 +1147,151 @@ func Test_ShouldNotUseSoocFolderForJpg_WhenNoSoocOptionIsSet(t *testing.T) {
 	}
 }
 
-func Test_ShouldProcessFiles_WhenMultipleSourcesAreGiven(t *testing.T) {
+func Test_ShouldUseProfileSettings_WhenProfileIsSelected(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	config := "dryrun = true\n\n[profiles.photos]\nfilter = [\"jpg\"]\n"
+	err := os.WriteFile(filepath.Join(destDir, ".shutter-pilot.toml"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dryrun from the config file is overridden on the command line
+	err = runSilently(t, "app", "--profile", "photos", "--dryrun=false", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		if m.Type == JpgFile {
+			err := m.CheckExistsAt(m.FullExpectedDestination())
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			err := m.CheckMissingAt(m.FullExpectedDestination())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func Test_ShouldNotUseSoocFolderForJpg_WhenNoSoocOptionIsSet(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	err := runSilently(t, "app", "--nosooc", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		if m.Type == JpgFile {
+			expectedPath := filepath.Dir(m.FullExpectedDestination())
+			err := m.CheckExistsAt(expectedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func Test_ShouldNotDeleteDuplicates_WhenConfirmDeleteIsOnlyInConfigFile(t *testing.T) {
+	for _, configFile := range []string{"user", "destination"} {
+		t.Run(configFile, func(t *testing.T) {
+			srcDir := makeSourceDirWithCleanup(t)
+			destDir := makeDestinationDirWithCleanup(t)
+			userConfigDir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", userConfigDir)
+
+			// Two copies in the library, the one that isn't placed would be deleted
+			captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+			data := movData(captured, "a")
+			duplicate := filepath.Join(destDir, "a.MOV")
+			for _, path := range []string{duplicate, movDestination(destDir, captured, "a.MOV")} {
+				err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(path, data, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			configPath := filepath.Join(destDir, ".shutter-pilot.toml")
+			if configFile == "user" {
+				configPath = filepath.Join(userConfigDir, "shutter-pilot", "config.toml")
+			}
+			err := os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(configPath, []byte("confirm-delete = true\n"), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = runSilently(t, "app", "--conflicts", "keep-placed", "--duplicates", "delete", srcDir, destDir)
+			if err == nil || !strings.Contains(err.Error(), "confirm-delete") {
+				t.Errorf("expected confirm-delete in the config file to be refused, got %v", err)
+			}
+
+			_, err = os.Stat(duplicate)
+			if err != nil {
+				t.Errorf("expected the duplicate to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func Test_ShouldFileLateNightCapturesUnderPreviousDay_WhenDayStartsAtIsSet(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	captured := time.Date(2024, 5, 5, 2, 0, 0, 0, time.Local)
+	err := os.WriteFile(filepath.Join(srcDir, "a.JPG"), jpgData(captured, "X-T4", "a"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(srcDir, "b.MOV"), movData(captured, "b"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSilently(t, "app", "import", "--day-starts-at", "04:00", srcDir, destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Photos and videos of the same night end up under the same day
+	for _, path := range []string{
+		filepath.Join(destDir, "photos", "2024", "2024-05-04", "sooc", "a.JPG"),
+		filepath.Join(destDir, "videos", "2024", "2024-05-04", "b.MOV"),
+	} {
+		_, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("expected %s to be filed under the previous day: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func Test_ShouldProcessFiles_WhenMultipleSourcesAreGiven(t *testing.T) {
 	srcDir1 := makeSourceDirWithCleanup(t)
 	srcDir2 := makeSourceDirWithCleanup(t)
 	destDir := makeDestinationDirWithCleanup(t)
@@ -658,22 +1302,1602 @@ func Test_ShouldProcessFiles_WhenMultipleSourcesAreGiven(t *testing.T) {
 			m.DestinationDir = destDir
 			m.CopyTo(srcDir1)
 
-		} else {
-			m.SourceDir = srcDir2
-			m.DestinationDir = destDir
-			m.CopyTo(srcDir2)
-		}
+		} else {
+			m.SourceDir = srcDir2
+			m.DestinationDir = destDir
+			m.CopyTo(srcDir2)
+		}
+	}
+	err := runSilently(t, "app", fmt.Sprintf("%s,%s", srcDir1, srcDir2), destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckExistsAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldProcessFiles_WhenAppliedInParallel(t *testing.T) {
+	srcDir1 := makeSourceDirWithCleanup(t)
+	srcDir2 := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for i, m := range validTestMediaFiles() {
+		if i%2 == 0 {
+			m.CopyTo(srcDir1)
+		} else {
+			m.CopyTo(srcDir2)
+		}
+	}
+	err := runSilently(t, "app", "--move", "--apply-workers", "8", "--device-workers", "0", fmt.Sprintf("%s,%s", srcDir1, srcDir2), destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir1
+		if i%2 != 0 {
+			m.SourceDir = srcDir2
+		}
+		m.DestinationDir = destDir
+
+		err := m.CheckExistsAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.CheckMissingAt(m.SourceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldReportActions_WhenPlanIsAppliedThroughLibrary(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
+	}
+
+	var applied []workflow.Action
+	planner := workflow.NewPlanner(workflow.Options{
+		Sources:     []string{srcDir},
+		Destination: destDir,
+		Events: workflow.EventHandler(func(e workflow.Event) {
+			if e.Type == workflow.EventAction {
+				applied = append(applied, *e.Action)
+			}
+		}),
+	})
+
+	plan, err := planner.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != len(validTestMediaFiles()) {
+		t.Fatalf("expected %d actions, got %d", len(validTestMediaFiles()), len(actions))
+	}
+	for _, a := range actions {
+		if a.Type != workflow.ActionCopy {
+			t.Fatalf("expected %s to be copied, got %s", a.Path, a.Type)
+		}
+	}
+
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != len(actions) {
+		t.Fatalf("expected %d applied actions, got %d", len(actions), len(applied))
+	}
+	for _, m := range validTestMediaFiles() {
+		err := m.CheckExistsAt(m.FullExpectedDestination())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ShouldImportCard_WhenCardIsMountedWhileWatching(t *testing.T) {
+	media := t.TempDir()
+	runMedia := filepath.Join(t.TempDir(), "run", "media", "me")
+	// Mounted before watching started, so it is left alone
+	err := os.MkdirAll(filepath.Join(media, "old", "DCIM"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	imported := make(chan string)
+	var events []workflow.Event
+	done := make(chan error)
+	go func() {
+		done <- workflow.WatchCards(ctx, []string{media, runMedia}, workflow.EventHandler(func(e workflow.Event) {
+			events = append(events, e)
+		}), func(ctx context.Context, dcim string) error {
+			imported <- dcim
+			if strings.Contains(dcim, "broken") {
+				return errors.New("card is broken")
+			}
+			return nil
+		})
+	}()
+
+	// Gives the watcher time to start
+	time.Sleep(200 * time.Millisecond)
+
+	for _, dcim := range []string{
+		filepath.Join(media, "broken", "DCIM"),
+		filepath.Join(media, "card", "DCIM"),
+		filepath.Join(runMedia, "card", "dcim"),
+	} {
+		err := os.MkdirAll(dcim, os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-imported:
+			if got != dcim {
+				t.Fatalf("expected card %s to be imported, got %s", dcim, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected card %s to be imported", dcim)
+		}
+	}
+
+	cancel()
+	err = <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected watching to end with context.Canceled, got %v", err)
+	}
+
+	counts := make(map[workflow.EventType]int)
+	for _, e := range events {
+		counts[e.Type]++
+	}
+	if counts[workflow.EventCardMounted] != 3 || counts[workflow.EventCardImported] != 2 || counts[workflow.EventCardFailed] != 1 {
+		t.Errorf("expected 3 mounted, 2 imported and 1 failed card, got %v", counts)
+	}
+}
+
+func Test_ShouldNotReportCardAsImported_WhenItsPlanIsBlocked(t *testing.T) {
+	media := t.TempDir()
+	library := t.TempDir()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	// Two copies of the same movie in the library conflict
+	for _, path := range []string{filepath.Join(library, "a.MOV"), movDestination(library, captured, "a.MOV")} {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, movData(captured, "a"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	imported := make(chan error)
+	var events []workflow.Event
+	done := make(chan error)
+	go func() {
+		done <- workflow.WatchCards(ctx, []string{media}, workflow.EventHandler(func(e workflow.Event) {
+			events = append(events, e)
+		}), func(ctx context.Context, dcim string) error {
+			plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{workflow.CardPrefix + filepath.Dir(dcim)}, Destination: library}).Plan(ctx)
+			if err == nil {
+				err = plan.Apply(ctx)
+			}
+			imported <- err
+			return err
+		})
+	}()
+
+	// Gives the watcher time to start
+	time.Sleep(200 * time.Millisecond)
+
+	// Written before the card shows up in the mount directory, like a mount
+	card := filepath.Join(t.TempDir(), "card")
+	err := os.MkdirAll(filepath.Join(card, "DCIM", "100_FUJI"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(card, "DCIM", "100_FUJI", "b.MOV"), movData(captured, "b"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(card, filepath.Join(media, "card"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-imported:
+		if !errors.Is(err, workflow.ErrBlocked) {
+			t.Fatalf("expected the plan of the card to be blocked, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the card to be imported")
+	}
+
+	cancel()
+	<-done
+
+	counts := make(map[workflow.EventType]int)
+	for _, e := range events {
+		counts[e.Type]++
+	}
+	if counts[workflow.EventCardImported] != 0 || counts[workflow.EventCardSkipped] != 1 {
+		t.Errorf("expected the card to be reported as skipped, got %v", counts)
+	}
+	if _, err := os.Stat(movDestination(library, captured, "b.MOV")); err == nil {
+		t.Error("expected nothing to be copied from the card")
+	}
+}
+
+// Returns the contents of a QuickTime movie captured at the given time. The
+// payload makes the contents of movies captured at the same time differ.
+func movData(captured time.Time, payload string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(24+len(payload)))
+	b.WriteString("moov")
+	binary.Write(&b, binary.BigEndian, uint32(16))
+	b.WriteString("mvhd")
+	// Version and flags, then seconds since 1904
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	binary.Write(&b, binary.BigEndian, uint32(captured.Unix()+2082844800))
+	b.WriteString(payload)
+	return b.Bytes()
+}
+
+func movDestination(library string, captured time.Time, name string) string {
+	day := captured.Local()
+	return filepath.Join(library, "videos", day.Format("2006"), day.Format("2006-01-02"), name)
+}
+
+func Test_ShouldCopyMedia_WhenPlanIsAppliedToMemoryFileSystem(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	files := []struct {
+		path     string
+		captured time.Time
+	}{
+		{"/card/DCIM/100/a.MOV", captured},
+		{"/card/DCIM/101/b.MOV", captured.AddDate(0, 0, 1)},
+	}
+	for _, f := range files {
+		err := fsys.WriteFile(f.path, movData(f.captured, f.path), f.captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		copied, err := fsys.ReadFile(movDestination("/library", f.captured, filepath.Base(f.path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied, movData(f.captured, f.path)) {
+			t.Fatalf("contents of %s changed while copying", f.path)
+		}
+		_, err = fsys.Stat(f.path)
+		if err != nil {
+			t.Fatalf("expected %s to stay in the source: %v", f.path, err)
+		}
+	}
+}
+
+func Test_ShouldImportMediaDirectoriesOnly_WhenSourceIsCard(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	imported := []string{
+		"/card/DCIM/100_FUJI/a.MOV",
+		"/card/DCIM/101_FUJI/b.MOV",
+		"/card/PRIVATE/M4ROOT/CLIP/C0001.MP4",
+	}
+	for _, path := range imported {
+		err := fsys.WriteFile(path, movData(captured, path), captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Thumbnails, camera files and resource forks that would fail to be read
+	for _, path := range []string{
+		"/card/DCIM/100_FUJI/._a.MOV",
+		"/card/DCIM/CANONMSC/M0100.MOV",
+		"/card/MISC/AUTPRINT.MRK",
+		"/card/PRIVATE/M4ROOT/CLIP/C0001M01.XML",
+		"/card/PRIVATE/M4ROOT/THMBNL/C0001T01.JPG",
+	} {
+		err := fsys.WriteFile(path, []byte("not media"), captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{workflow.CardPrefix + "/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != len(imported) {
+		t.Fatalf("expected %d actions, got %d: %v", len(imported), len(actions), actions)
+	}
+	for _, a := range actions {
+		if a.Type != workflow.ActionCopy || !slices.Contains(imported, a.Path) {
+			t.Errorf("unexpected action %s %s", a.Type, a.Path)
+		}
+	}
+
+	_, err = workflow.NewPlanner(workflow.Options{Sources: []string{workflow.CardPrefix + "/library"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for a card without media directories")
+	}
+}
+
+func Test_ShouldLeaveOutExcludedFiles_WhenScanning(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	for _, path := range []string{"/card/DSCF0001.MOV", "/card/DSCF0002.MOV", "/card/IMG_0003.MOV", "/card/rejects/DSCF0004.MOV", "/card/exports/DSCF0005.MOV"} {
+		err := fsys.WriteFile(path, movData(captured, path), captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Would fail to be read if they were scanned
+	for _, path := range []string{"/card/._DSCF0001.MOV", "/card/.Trashes/501/DSCF0009.MOV", "/card/@eaDir/DSCF0001.MOV/SYNOPHOTO_THUMB_XL.jpg", "/card/Catalog Previews.lrdata/0/0A/x.jpg"} {
+		err := fsys.WriteFile(path, []byte("not media"), captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.WriteFile("/card/.shutterpilotignore", []byte("# shots that didn't make it\nrejects\n"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{
+		Sources:     []string{"/card"},
+		Destination: "/library",
+		Exclude:     []string{"exports/*"},
+		Include:     []string{"DSCF*"},
+		FS:          fsys,
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, a := range actions {
+		paths = append(paths, a.Path)
+	}
+	slices.Sort(paths)
+	want := []string{"/card/DSCF0001.MOV", "/card/DSCF0002.MOV"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("expected actions for %v, got %v", want, paths)
+	}
+}
+
+func Test_ShouldFindLibraryFiles_WhenTheyDontMatchSourcePatterns(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	data := movData(captured, "DSCF0001.MOV")
+	err := fsys.WriteFile("/card/DSCF0001.MOV", data, captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renamed in the library, neither pattern must hide it
+	err = fsys.WriteFile("/library/2024/05/04/exports/IMG_0001.MOV", data, captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{
+		Sources:     []string{"/card"},
+		Destination: "/library",
+		Exclude:     []string{"exports"},
+		Include:     []string{"DSCF*"},
+		FS:          fsys,
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range actions {
+		if strings.HasPrefix(a.Path, "/card/") && (a.Type == workflow.ActionCopy || a.Type == workflow.ActionMove) {
+			t.Errorf("expected %s to be found in the library, got %s action", a.Path, a.Type)
+		}
+	}
+}
+
+func Test_ShouldScanLinkedDirectories_WhenSymlinksAreFollowed(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "source")
+	library := filepath.Join(root, "library")
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	for _, path := range []string{filepath.Join(source, "a.MOV"), filepath.Join(root, "elsewhere", "b.MOV")} {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, movData(captured, path), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(library, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(root, "elsewhere"), filepath.Join(source, "linked"))
+	if err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+	// Leads back to the source, which would be walked forever
+	err = os.Symlink(source, filepath.Join(source, "loop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		follow bool
+		want   []string
+	}{
+		{false, []string{filepath.Join(source, "a.MOV")}},
+		{true, []string{filepath.Join(source, "a.MOV"), filepath.Join(source, "linked", "b.MOV")}},
+	}
+	for _, tt := range tests {
+		plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{source}, Destination: library, FollowSymlinks: tt.follow}).Plan(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions, err := plan.Actions()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, a := range actions {
+			paths = append(paths, a.Path)
+		}
+		slices.Sort(paths)
+		if !slices.Equal(paths, tt.want) {
+			t.Errorf("following links %v: expected actions for %v, got %v", tt.follow, tt.want, paths)
+		}
+	}
+}
+
+func Test_ShouldNotConflict_WhenDestinationCopiesAreHardLinked(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	placed := movDestination("/library", captured, "a.MOV")
+	err := fsys.WriteFile(placed, movData(captured, "a"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Link(placed, "/library/a-copy.MOV")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dedupe bool
+		want   []workflow.ActionType
+	}{
+		{false, []workflow.ActionType{workflow.ActionConflict, workflow.ActionMove}},
+		{true, nil},
+	}
+	for _, tt := range tests {
+		plan, err := workflow.NewPlanner(workflow.Options{Destination: "/library", DedupeHardLinks: tt.dedupe, FS: fsys}).Plan(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions, err := plan.Actions()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var types []workflow.ActionType
+		for _, a := range actions {
+			types = append(types, a.Type)
+		}
+		slices.Sort(types)
+		if !slices.Equal(types, tt.want) {
+			t.Errorf("deduping hard links %v: expected actions %v, got %v", tt.dedupe, tt.want, types)
+		}
+	}
+}
+
+// Returns the contents of a JPEG photo with EXIF data that records the camera
+// model and the capture time. The payload makes the contents of photos
+// captured at the same time differ.
+func jpgData(captured time.Time, model, payload string) []byte {
+	strs := []string{model + "\x00", captured.Format("2006:01:02 15:04:05") + "\x00"}
+	tags := []uint16{0x0110, 0x0132}
+
+	var tiff bytes.Buffer
+	tiff.WriteString("II")
+	binary.Write(&tiff, binary.LittleEndian, uint16(42))
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	binary.Write(&tiff, binary.LittleEndian, uint16(len(tags)))
+	// Strings are kept after the entries of IFD0 and the offset of the next IFD
+	offset := uint32(8 + 2 + 12*len(tags) + 4)
+	var values bytes.Buffer
+	for i, tag := range tags {
+		binary.Write(&tiff, binary.LittleEndian, tag)
+		binary.Write(&tiff, binary.LittleEndian, uint16(2))
+		binary.Write(&tiff, binary.LittleEndian, uint32(len(strs[i])))
+		if len(strs[i]) <= 4 {
+			tiff.WriteString(strs[i] + strings.Repeat("\x00", 4-len(strs[i])))
+			continue
+		}
+		binary.Write(&tiff, binary.LittleEndian, offset+uint32(values.Len()))
+		values.WriteString(strs[i])
+	}
+	binary.Write(&tiff, binary.LittleEndian, uint32(0))
+	tiff.Write(values.Bytes())
+
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(2+6+tiff.Len()))
+	b.WriteString("Exif\x00\x00")
+	b.Write(tiff.Bytes())
+	b.Write([]byte{0xFF, 0xD9})
+	b.WriteString(payload)
+	return b.Bytes()
+}
+
+func Test_ShouldOrganiseOnlyMediaCapturedInRange_WhenSinceAndUntilAreSet(t *testing.T) {
+	fsys := storage.NewMem()
+	files := []struct {
+		path     string
+		captured time.Time
+		kept     bool
+	}{
+		{"/card/DCIM/100/a.MOV", time.Date(2024, 4, 28, 12, 0, 0, 0, time.Local), false},
+		{"/card/DCIM/100/b.MOV", time.Date(2024, 5, 4, 9, 0, 0, 0, time.Local), true},
+		{"/card/DCIM/100/c.MOV", time.Date(2024, 5, 5, 23, 0, 0, 0, time.Local), true},
+		{"/card/DCIM/100/d.MOV", time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local), false},
+	}
+	for _, f := range files {
+		err := fsys.WriteFile(f.path, movData(f.captured, f.path), f.captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Emitted from the scan workers
+	var mu sync.Mutex
+	fingerprinted := make(map[string]bool)
+	plan, err := workflow.NewPlanner(workflow.Options{
+		Sources:     []string{"/card"},
+		Destination: "/library",
+		Since:       time.Date(2024, 5, 4, 0, 0, 0, 0, time.Local),
+		Until:       time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local),
+		FS:          fsys,
+		Events: workflow.EventHandler(func(e workflow.Event) {
+			if e.Type == workflow.EventFileScanned {
+				mu.Lock()
+				fingerprinted[e.Path] = true
+				mu.Unlock()
+			}
+		}),
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if fingerprinted[f.path] != f.kept {
+			t.Errorf("expected %s to be fingerprinted only when kept, fingerprinted: %v", f.path, fingerprinted[f.path])
+		}
+	}
+
+	summary, err := plan.Summary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Copies != 2 || summary.Filtered != 2 {
+		t.Fatalf("expected 2 copies and 2 files left out, got %+v", summary)
+	}
+
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_, err := fsys.Stat(movDestination("/library", f.captured, filepath.Base(f.path)))
+		if f.kept && err != nil {
+			t.Errorf("expected %s to be copied: %v", f.path, err)
+		}
+		if !f.kept && err == nil {
+			t.Errorf("expected %s to be left out", f.path)
+		}
+	}
+}
+
+func Test_ShouldOrganiseOnlyMediaOfCamera_WhenCameraIsSet(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	photos := map[string][]byte{
+		"/card/DCIM/100_FUJI/a.JPG": jpgData(captured, "X-T4", "a"),
+		"/card/DCIM/100_FUJI/b.JPG": jpgData(captured, "X100V", "b"),
+		"/card/DCIM/100_FUJI/c.MOV": movData(captured, "c"),
+	}
+	for path, data := range photos {
+		err := fsys.WriteFile(path, data, captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{
+		Sources:     []string{"/card"},
+		Destination: "/library",
+		Cameras:     []string{"x-t4"},
+		FS:          fsys,
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join("/library", "photos", "2024", "2024-05-04", "sooc")
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{"a.JPG"}) {
+		t.Errorf("expected only a.JPG in %s, got %v", dir, names)
+	}
+	_, err = fsys.Stat(movDestination("/library", captured, "c.MOV"))
+	if err == nil {
+		t.Error("expected video to be left out when filtering by camera")
+	}
+}
+
+func Test_ShouldKeepPlacedCopy_WhenDedupingLibraries(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	data := movData(captured, "a")
+	placed := movDestination("/library", captured, "a.MOV")
+	for _, path := range []string{"/archive/a.MOV", placed, "/library/exports/a.MOV"} {
+		err := fsys.WriteFile(path, data, captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hard link to a copy is removed together with it, the space is only
+	// reclaimed once both are gone
+	err := fsys.Link("/archive/a.MOV", "/archive/a-link.MOV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.WriteFile("/archive/b.MOV", movData(captured, "b"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewDeduper(workflow.DedupeOptions{
+		Roots:  []string{"/library", "/archive"},
+		Action: workflow.DedupeQuarantine,
+		Keep:   workflow.KeepPlaced,
+		FS:     fsys,
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := plan.Sets()
+	if len(sets) != 1 {
+		t.Fatalf("expected 1 duplicate set, got %v", sets)
+	}
+	if sets[0].Kept != placed {
+		t.Errorf("expected %s to be kept, got %s", placed, sets[0].Kept)
+	}
+	wantCopies := []string{"/archive/a-link.MOV", "/archive/a.MOV", "/library/exports/a.MOV"}
+	if !slices.Equal(sets[0].Copies, wantCopies) {
+		t.Errorf("expected copies %v, got %v", wantCopies, sets[0].Copies)
+	}
+	want := workflow.DedupeSummary{Sets: 1, Copies: 2, Reclaimable: 2 * int64(len(data))}
+	if plan.DedupeSummary() != want {
+		t.Errorf("expected summary %+v, got %+v", want, plan.DedupeSummary())
+	}
+
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range wantCopies {
+		_, err := fsys.Stat(path)
+		if err == nil {
+			t.Errorf("expected %s to be quarantined", path)
+		}
+	}
+	for _, path := range []string{placed, "/archive/b.MOV", "/archive/.shutter-pilot/quarantine/a.MOV", "/library/.shutter-pilot/quarantine/exports/a.MOV"} {
+		_, err := fsys.Stat(path)
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+		}
+	}
+}
+
+func Test_ShouldOnlyListDuplicates_WhenDedupeActionIsList(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	for _, path := range []string{"/library/a.MOV", "/library/b.MOV"} {
+		err := fsys.WriteFile(path, movData(captured, "a"), captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events []workflow.Event
+	plan, err := workflow.NewDeduper(workflow.DedupeOptions{
+		Roots:  []string{"/library"},
+		Action: workflow.DedupeList,
+		Events: workflow.EventHandler(func(e workflow.Event) { events = append(events, e) }),
+		FS:     fsys,
+	}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 0 {
+		t.Errorf("expected no actions when listing, got %v", actions)
+	}
+
+	var listed []string
+	for _, e := range events {
+		if e.Type == workflow.EventDuplicateSet {
+			listed = append(listed, e.Duplicates.Kept)
+			listed = append(listed, e.Duplicates.Copies...)
+		}
+	}
+	if !slices.Equal(listed, []string{"/library/a.MOV", "/library/b.MOV"}) {
+		t.Errorf("expected the set of a.MOV and b.MOV to be listed, got %v", listed)
+	}
+}
+
+func Test_ShouldKeepBothFiles_WhenOnlyTheirStartAndEndMatch(t *testing.T) {
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	// Larger than the chunks that are fingerprinted, so the middle isn't read
+	payload := make([]byte, 3*1024*1024)
+	a := movData(captured, string(payload))
+	payload[len(payload)/2] = 1
+	b := movData(captured, string(payload))
+
+	for _, action := range []workflow.DedupeAction{workflow.DedupeLink, workflow.DedupeQuarantine, workflow.DedupeDelete} {
+		t.Run(string(action), func(t *testing.T) {
+			fsys := storage.NewMem()
+			for path, data := range map[string][]byte{"/library/a.MOV": a, "/library/b.MOV": b} {
+				err := fsys.WriteFile(path, data, captured)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			plan, err := workflow.NewDeduper(workflow.DedupeOptions{
+				Roots:       []string{"/library"},
+				Action:      action,
+				AllowDelete: true,
+				FS:          fsys,
+			}).Plan(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Sets()) != 0 {
+				t.Errorf("expected no duplicate sets, got %+v", plan.Sets())
+			}
+
+			err = plan.Apply(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for path, data := range map[string][]byte{"/library/a.MOV": a, "/library/b.MOV": b} {
+				got, err := fsys.ReadFile(path)
+				if err != nil {
+					t.Fatalf("expected %s to be kept: %v", path, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("expected %s to be left as it is", path)
+				}
+			}
+		})
+	}
+}
+
+func Test_ShouldReportLibraryStatistics_WhenStatsAreCollected(t *testing.T) {
+	fsys := storage.NewMem()
+	may := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	june := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	dir := filepath.Join("/library", "photos", "2024", "2024-05-04", "sooc")
+	files := []struct {
+		path string
+		data []byte
+	}{
+		// Without a capture time, so it can't be paired with a.JPG
+		{filepath.Join("/library", "photos", "2024", "2024-05-04", "a.RAF"), []byte("raw")},
+		{filepath.Join(dir, "a.JPG"), jpgData(may, "X-T4", "a")},
+		{filepath.Join(dir, "b.JPG"), jpgData(may, "X-T4", "b")},
+		{"/library/inbox/c.JPG", jpgData(june, "X100V", "c")},
+		{movDestination("/library", june, "d.MOV"), movData(june, "d")},
+	}
+	for _, f := range files {
+		err := fsys.WriteFile(f.path, f.data, may)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reported *workflow.LibraryStats
+	var scanned *workflow.Progress
+	stats, err := workflow.CollectStats(context.Background(), workflow.StatsOptions{
+		Destination: "/library",
+		LargestDays: 1,
+		Events: workflow.EventHandler(func(e workflow.Event) {
+			switch e.Type {
+			case workflow.EventStats:
+				reported = e.Stats
+			case workflow.EventPhaseDone:
+				scanned = e.Progress
+			}
+		}),
+		FS: fsys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reported == nil {
+		t.Fatal("expected the statistics to be reported in an event")
+	}
+	// Only metadata is read, nothing is fingerprinted
+	if scanned == nil || scanned.Phase != "reading metadata" || scanned.Done != 5 || scanned.DoneBytes != 0 {
+		t.Errorf("expected the metadata of 5 files to be read without fingerprinting them, got %+v", scanned)
+	}
+
+	if stats.Total.Files != 5 {
+		t.Errorf("expected 5 files, got %d", stats.Total.Files)
+	}
+
+	var months []string
+	for _, g := range stats.Months {
+		months = append(months, fmt.Sprintf("%s:%d", g.Key, g.Files))
+	}
+	if !slices.Equal(months, []string{"2024-05:2", "2024-06:2", "unknown:1"}) {
+		t.Errorf("unexpected months %v", months)
+	}
+
+	if len(stats.Cameras) == 0 || stats.Cameras[0].Key != "X-T4" || stats.Cameras[0].Files != 2 {
+		t.Errorf("expected X-T4 to be the largest camera with 2 files, got %v", stats.Cameras)
+	}
+
+	if len(stats.LargestDays) != 1 {
+		t.Errorf("expected only the largest day, got %v", stats.LargestDays)
+	}
+
+	misplaced := []workflow.MisplacedFile{{
+		Path:        "/library/inbox/c.JPG",
+		Destination: filepath.Join("/library", "photos", "2024", "2024-06-01", "sooc", "c.JPG"),
+	}}
+	if !slices.Equal(stats.Misplaced, misplaced) {
+		t.Errorf("expected %v to be misplaced, got %v", misplaced, stats.Misplaced)
+	}
+
+	unpaired := []string{"/library/inbox/c.JPG", filepath.Join(dir, "a.JPG"), filepath.Join(dir, "b.JPG")}
+	if !slices.Equal(stats.Unpaired, unpaired) {
+		t.Errorf("expected %v to be unpaired, got %v", unpaired, stats.Unpaired)
+	}
+	if len(stats.Undated) != 1 {
+		t.Errorf("expected the RAF without a capture time to be undated, got %v", stats.Undated)
+	}
+}
+
+func Test_ShouldMoveFilesBack_WhenMoveIsUndoneInMemoryFileSystem(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	err := fsys.WriteFile("/card/a.MOV", movData(captured, "a"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := workflow.Options{Sources: []string{"/card"}, Destination: "/library", MoveMode: true, FS: fsys}
+	plan, err := workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved := movDestination("/library", captured, "a.MOV")
+	if _, err := fsys.Stat(moved); err != nil {
+		t.Fatalf("expected file to be moved: %v", err)
+	}
+	if _, err := fsys.Stat("/card/a.MOV"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected file to be gone from the source, got %v", err)
+	}
+
+	journals, err := fsys.ReadDir("/library/.shutter-pilot/journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 1 {
+		t.Fatalf("expected a journal, got %d", len(journals))
+	}
+	summary, err := workflow.Undo(context.Background(), filepath.Join("/library/.shutter-pilot/journal", journals[0].Name()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Restored != 1 {
+		t.Fatalf("expected a restored file, got %d", summary.Restored)
+	}
+	if _, err := fsys.Stat("/card/a.MOV"); err != nil {
+		t.Fatalf("expected file to be moved back: %v", err)
+	}
+	if _, err := fsys.Stat(moved); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected file to be gone from the library, got %v", err)
+	}
+}
+
+func Test_ShouldLinkDuplicates_WhenHardlinkStrategyIsUsedInMemoryFileSystem(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	placed := movDestination("/library", captured, "a.MOV")
+	data := movData(captured, "a")
+	for _, path := range []string{placed, "/library/unsorted/a.MOV"} {
+		err := fsys.WriteFile(path, data, captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/card", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := workflow.Options{
+		Sources:        []string{"/card"},
+		Destination:    "/library",
+		ConflictPolicy: workflow.ConflictPolicy{Strategy: workflow.ConflictHardlink},
+		FS:             fsys,
+	}
+	plan, err := workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placedInfo, err := fsys.Stat(placed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicateInfo, err := fsys.Stat("/library/unsorted/a.MOV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fsys.SameFile(placedInfo, duplicateInfo) {
+		t.Fatal("expected duplicate to be linked to the placed file")
+	}
+}
+
+// Both ends of the connection to an SFTP server.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// Starts an SFTP server in the test that serves the local disk, standing in
+// for a server reached over SSH.
+func startSFTPServer(t *testing.T) *sftp.Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	server, err := sftp.NewServer(pipeConn{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client waits for the server to hang up when it is closed
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func Test_ShouldMoveMedia_WhenDestinationIsOnSFTPServer(t *testing.T) {
+	sourceDir := makeSourceDirWithCleanup(t)
+	destDir, err := filepath.Abs(makeDestinationDirWithCleanup(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captured := time.Date(2024, 7, 14, 18, 30, 0, 0, time.UTC)
+	data := movData(captured, "a")
+	source := filepath.Join(sourceDir, "a.MOV")
+	err = os.WriteFile(source, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := storage.NewMux(storage.OS{})
+	fsys.Mount("sftp://nas", storage.NewSFTP(startSFTPServer(t), "sftp://nas"))
+
+	options := workflow.Options{
+		Sources:     []string{sourceDir},
+		Destination: "sftp://nas" + filepath.ToSlash(destDir),
+		MoveMode:    true,
+		FS:          fsys,
+	}
+	plan, err := workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := os.ReadFile(movDestination(destDir, captured, "a.MOV"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(moved, data) {
+		t.Fatal("contents changed while moving to the server")
+	}
+	if _, err := os.Stat(source); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected source to be removed after moving, got %v", err)
+	}
+
+	// Planning again finds the file in place on the server
+	plan, err = workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 0 {
+		t.Fatalf("expected nothing left to do, got %v", actions)
+	}
+}
+
+func Test_ShouldCheckFreeSpace_WhenPlanIsApplied(t *testing.T) {
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	data := movData(captured, "a")
+	size := uint64(len(data))
+
+	tests := []struct {
+		name    string
+		free    uint64
+		blocked bool
+		warned  bool
+	}{
+		{"Not enough space", size - 1, true, false},
+		{"Less than margin left", size + 10, false, true},
+		{"Enough space", size + 1024, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := storage.NewMem()
+			err := fsys.WriteFile("/card/DCIM/100/a.MOV", data, captured)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fsys.MkdirAll("/library", 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fsys.SetFreeSpace(tt.free)
+
+			var blocked, warned bool
+			plan, err := workflow.NewPlanner(workflow.Options{
+				Sources:     []string{"/card"},
+				Destination: "/library",
+				ApplyLimits: workflow.ApplyLimits{Workers: 1, SpaceMargin: 1024},
+				Events: workflow.EventHandler(func(e workflow.Event) {
+					switch e.Type {
+					case workflow.EventBlocked:
+						blocked = true
+					case workflow.EventWarning:
+						warned = warned || strings.Contains(e.Message, "will be left free")
+					}
+				}),
+				FS: fsys,
+			}).Plan(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = plan.Apply(context.Background())
+			if tt.blocked != errors.Is(err, workflow.ErrBlocked) {
+				t.Fatalf("expected blocked to be %v, got %v", tt.blocked, err)
+			}
+			if !tt.blocked && err != nil {
+				t.Fatal(err)
+			}
+			if blocked != tt.blocked {
+				t.Errorf("expected blocked event to be %v, got %v", tt.blocked, blocked)
+			}
+			if warned != tt.warned {
+				t.Errorf("expected low space warning to be %v, got %v", tt.warned, warned)
+			}
+
+			if tt.blocked {
+				entries, err := fsys.ReadDir("/library")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != 0 {
+					t.Errorf("expected nothing to be copied, got %v", entries)
+				}
+				return
+			}
+			_, err = fsys.Stat(movDestination("/library", captured, "a.MOV"))
+			if err != nil {
+				t.Errorf("expected a.MOV to be copied: %v", err)
+			}
+		})
+	}
+}
+
+// In-memory file system that counts how often each file is opened for reading.
+type openCountingMem struct {
+	*storage.Mem
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (m *openCountingMem) Open(name string) (storage.File, error) {
+	m.mu.Lock()
+	m.opened[name]++
+	m.mu.Unlock()
+	return m.Mem.Open(name)
+}
+
+func Test_ShouldOpenEachFileOnce_WhenPlanIsCreated(t *testing.T) {
+	fsys := &openCountingMem{Mem: storage.NewMem(), opened: make(map[string]int)}
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	files := map[string][]byte{
+		"/card/DCIM/100/a.JPG":                        jpgData(captured, "X-T4", "a"),
+		"/card/DCIM/100/b.MOV":                        movData(captured, "b"),
+		movDestination("/library", captured, "c.MOV"): movData(captured, "c"),
+	}
+	for path, data := range files {
+		err := fsys.WriteFile(path, data, captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fingerprint and capture time are read from the same handle
+	for path := range files {
+		if fsys.opened[path] != 1 {
+			t.Errorf("expected %s to be opened once, got %d", path, fsys.opened[path])
+		}
+	}
+}
+
+func Test_ShouldReportProgressInBytes_WhenPlanIsApplied(t *testing.T) {
+	fsys := storage.NewMem()
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.Local)
+	var size int64
+	for _, path := range []string{"/card/DCIM/100/a.MOV", "/card/DCIM/100/b.MOV"} {
+		data := movData(captured, path)
+		size += int64(len(data))
+		err := fsys.WriteFile(path, data, captured)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []workflow.Progress
+	events := workflow.EventHandler(func(e workflow.Event) {
+		if e.Type == workflow.EventPhaseDone {
+			phases = append(phases, *e.Progress)
+		}
+	})
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", Events: events, FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source, the empty library and the copies. Files smaller than a chunk
+	// are read whole to be fingerprinted.
+	want := []string{"fingerprinting", "fingerprinting", "applying"}
+	if len(phases) != len(want) {
+		t.Fatalf("expected phases %v, got %+v", want, phases)
+	}
+	for _, i := range []int{0, 2} {
+		p := phases[i]
+		if p.Phase != want[i] || !p.Counted || p.Done != 2 || p.Total != 2 || p.DoneBytes != size || p.TotalBytes != size {
+			t.Errorf("expected %s to be done with 2 of 2 and %d of %d bytes, got %+v", want[i], size, size, p)
+		}
+	}
+}
+
+func TestTextSinkProgress(t *testing.T) {
+	progress := func(elapsed time.Duration) workflow.Event {
+		p := workflow.Progress{Phase: "applying", Unit: "actions", Done: 1, Total: 2, DoneBytes: 1024, TotalBytes: 2048, Counted: true, Elapsed: elapsed}
+		return workflow.Event{Type: workflow.EventProgress, Message: fmt.Sprintf("applying at %s", elapsed), Progress: &p}
+	}
+
+	tests := []struct {
+		name    string
+		elapsed []time.Duration
+		want    []string
+	}{
+		{"Before interval", []time.Duration{time.Second}, nil},
+		{"Every interval", []time.Duration{5 * time.Second, 10 * time.Second, 15 * time.Second, 21 * time.Second}, []string{"  applying at 10s", "  applying at 21s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			// Not a terminal, so progress is logged instead of updated in place
+			sink := workflow.NewTextSink(&out, slog.LevelInfo)
+			for _, elapsed := range tt.elapsed {
+				sink.Handle(progress(elapsed))
+			}
+
+			var got []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if line != "" {
+					got = append(got, line)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q to be logged, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// In-memory file system whose files only appear once complete, like a bucket,
+// that records the renames made on it.
+type atomicMem struct {
+	*storage.Mem
+	renamed []string
+}
+
+func (m *atomicMem) CreatesAtomically(name string) bool {
+	return true
+}
+
+func (m *atomicMem) Rename(oldname, newname string) error {
+	m.renamed = append(m.renamed, oldname)
+	return m.Mem.Rename(oldname, newname)
+}
+
+func Test_ShouldCopyWithoutTemporaryName_WhenDestinationCreatesFilesAtomically(t *testing.T) {
+	fsys := &atomicMem{Mem: storage.NewMem()}
+	captured := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+	err := fsys.WriteFile("/card/a.MOV", movData(captured, "a"), captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.MkdirAll("/library", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := workflow.NewPlanner(workflow.Options{Sources: []string{"/card"}, Destination: "/library", FS: fsys}).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fsys.Stat(movDestination("/library", captured, "a.MOV"))
+	if err != nil {
+		t.Fatalf("expected the file to be copied: %v", err)
+	}
+	for _, path := range fsys.renamed {
+		if strings.HasSuffix(path, ".partial") {
+			t.Errorf("expected the copy to be written to its path straight away, %s was renamed", path)
+		}
+	}
+}
+
+// Runs against the bucket in SHUTTER_PILOT_TEST_S3, e.g. s3://test on a local
+// MinIO with AWS_ENDPOINT_URL=http://localhost:9000 and its credentials set.
+func Test_ShouldCopyMedia_WhenDestinationIsS3Bucket(t *testing.T) {
+	bucket := os.Getenv("SHUTTER_PILOT_TEST_S3")
+	if bucket == "" {
+		t.Skip("SHUTTER_PILOT_TEST_S3 not set")
+	}
+
+	remote, err := storage.DialS3(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := storage.NewMux(storage.OS{})
+	fsys.Mount(remote.Root(), remote)
+
+	sourceDir := makeSourceDirWithCleanup(t)
+	captured := time.Date(2024, 8, 2, 9, 15, 0, 0, time.UTC)
+	// Larger than a part, so it is uploaded in several
+	data := movData(captured, strings.Repeat("a", 17*1024*1024))
+	err = os.WriteFile(filepath.Join(sourceDir, "a.MOV"), data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := workflow.Options{
+		Sources:     []string{sourceDir},
+		Destination: fmt.Sprintf("%s/test-%d", remote.Root(), time.Now().UnixNano()),
+		FS:          fsys,
+	}
+	plan, err := workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := movDestination(options.Destination, captured, "a.MOV")
+	t.Cleanup(func() { fsys.Remove(uploaded) })
+	info, err := fsys.Stat(uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("expected %d bytes to be uploaded, got %d", len(data), info.Size())
+	}
+	fingerprint, err := fsys.Fingerprint(uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint == "" {
+		t.Fatal("expected the fingerprint to be kept with the object")
+	}
+
+	// The kept fingerprint finds the object in place
+	plan, err = workflow.NewPlanner(options).Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := plan.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Type != workflow.ActionSkip {
+		t.Fatalf("expected the file to be skipped, got %v", actions)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := storage.NewMem()
+	modTime := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	err := fsys.WriteFile("/a/b/file", []byte("contents"), modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fsys.Create("/missing/file")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Create() in missing directory error = %v, want not exist", err)
+	}
+
+	f, err := fsys.Append("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(" and more"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data, err := fsys.ReadFile("/a/b/file")
+	if err != nil || string(data) != "contents and more" {
+		t.Errorf("ReadFile() after append = %q, %v", data, err)
+	}
+
+	err = fsys.Link("/a/b/file", "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Link("/a/b/file", "/a/link")
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("Link() to existing file error = %v, want exist", err)
+	}
+
+	err = fsys.Remove("/a")
+	if err == nil {
+		t.Error("Remove() of directory that is not empty succeeded")
+	}
+
+	err = fsys.Rename("/a/b", "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fsys.Stat("/c/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("contents and more")) || !info.ModTime().After(modTime) {
+		t.Errorf("Stat() after rename = size %d, modified %s", info.Size(), info.ModTime())
+	}
+	linkInfo, err := fsys.Stat("/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fsys.SameFile(info, linkInfo) {
+		t.Error("SameFile() of hard links = false")
+	}
+
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !equalSlices(names, []string{"a", "c"}) {
+		t.Errorf("ReadDir() = %v, want [a c]", names)
+	}
+}
+
+func Test_ShouldPrintEventsAsJSONLines_WhenLogFormatIsJSON(t *testing.T) {
+	srcDir := makeSourceDirWithCleanup(t)
+	destDir := makeDestinationDirWithCleanup(t)
+
+	for _, m := range validTestMediaFiles() {
+		m.SourceDir = srcDir
+		m.DestinationDir = destDir
+		m.CopyTo(srcDir)
 	}
-	err := runSilently(t, "app", fmt.Sprintf("%s,%s", srcDir1, srcDir2), destDir)
+
+	stdout, err := os.CreateTemp("", "tmp_stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdout.Close()
+		os.Remove(stdout.Name())
+	})
+	originalStdout := os.Stdout
+	os.Stdout = stdout
+	err = runWithVolume(t, false, "app", "--log-format", "json", srcDir, destDir)
+	os.Stdout = originalStdout
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for _, m := range validTestMediaFiles() {
-		err := m.CheckExistsAt(m.FullExpectedDestination())
+	_, err = stdout.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[workflow.EventType]int)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var e struct {
+			Type   workflow.EventType `json:"type"`
+			Action *workflow.Action   `json:"action"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &e)
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("line is not a JSON event: %s: %v", scanner.Text(), err)
+		}
+		if (e.Type == workflow.EventPlanned || e.Type == workflow.EventAction) && e.Action == nil {
+			t.Fatalf("%s event without action: %s", e.Type, scanner.Text())
 		}
+		counts[e.Type]++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts[workflow.EventPlanned] != len(validTestMediaFiles()) {
+		t.Fatalf("expected %d planned events, got %d", len(validTestMediaFiles()), counts[workflow.EventPlanned])
+	}
+	if counts[workflow.EventAction] != len(validTestMediaFiles()) {
+		t.Fatalf("expected %d action events, got %d", len(validTestMediaFiles()), counts[workflow.EventAction])
+	}
+	if counts[workflow.EventPlanSummary] != 1 {
+		t.Fatalf("expected a plan summary event, got %d", counts[workflow.EventPlanSummary])
 	}
 }
 
@@ -872,6 +3096,450 @@ func TestValidateFileTypes(t *testing.T) {
 	}
 }
 
+func TestValidatePatterns(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []string
+		expectErr bool
+	}{
+		{"Empty", "", nil, false},
+		{"Names and paths", "*.jpg, exports/*", []string{"*.jpg", "exports/*"}, false},
+		{"Malformed pattern", "[a-", nil, true},
+		{"Empty entry", "*.jpg,,*.raf", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validatePatterns(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("validatePatterns() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("validatePatterns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDayStartsAt(t *testing.T) {
+	tests := []struct {
+		name        string
+		dayStartsAt string
+		want        time.Duration
+		expectErr   bool
+	}{
+		{"Not provided", "", 0, false},
+		{"Midnight", "00:00", 0, false},
+		{"Early morning", "04:00", 4 * time.Hour, false},
+		{"Hours and minutes", "05:30", 5*time.Hour + 30*time.Minute, false},
+		{"Surrounding spaces", " 04:00 ", 4 * time.Hour, false},
+		{"Missing minutes", "4", 0, true},
+		{"Hour out of range", "24:00", 0, true},
+		{"Minute out of range", "04:60", 0, true},
+		{"Not a time", "late", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateDayStartsAt(tt.dayStartsAt)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateDayStartsAt() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateDayStartsAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCaptureRange(t *testing.T) {
+	day := func(d int, hour int) time.Time {
+		return time.Date(2024, 5, d, hour, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name        string
+		since       string
+		until       string
+		dayStartsAt time.Duration
+		wantSince   time.Time
+		wantUntil   time.Time
+		expectErr   bool
+	}{
+		{"Not provided", "", "", 0, time.Time{}, time.Time{}, false},
+		{"Days", "2024-05-04", "2024-05-05", 0, day(4, 0), day(6, 0), false},
+		{"Same day", "2024-05-04", "2024-05-04", 0, day(4, 0), day(5, 0), false},
+		{"Only since", "2024-05-04", "", 0, day(4, 0), time.Time{}, false},
+		{"Only until", "", "2024-05-04", 0, time.Time{}, day(5, 0), false},
+		{"Day starts later", "2024-05-04", "2024-05-04", 4 * time.Hour, day(4, 4), day(5, 4), false},
+		{"Times", "2024-05-04T18:00", "2024-05-05T02:00", 4 * time.Hour, day(4, 18), day(5, 2), false},
+		{"Seconds", "2024-05-04T18:00:00", "", 0, day(4, 18), time.Time{}, false},
+		{"Until before since", "2024-05-05", "2024-05-04", 0, time.Time{}, time.Time{}, true},
+		{"Not a date", "last week", "", 0, time.Time{}, time.Time{}, true},
+		{"Day out of range", "", "2024-05-32", 0, time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, until, err := validateCaptureRange(tt.since, tt.until, tt.dayStartsAt)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("validateCaptureRange() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !since.Equal(tt.wantSince) || !until.Equal(tt.wantUntil) {
+				t.Errorf("validateCaptureRange() = %v, %v, want %v, %v", since, until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestValidateConflictPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		strategy  string
+		disposal  string
+		want      workflow.ConflictPolicy
+		expectErr bool
+	}{
+		{"Defaults", "manual", "quarantine", workflow.ConflictPolicy{Strategy: workflow.ConflictManual, Disposal: workflow.DisposeQuarantine}, false},
+		{"Keep placed", "keep-placed", "delete", workflow.ConflictPolicy{Strategy: workflow.ConflictKeepPlaced, Disposal: workflow.DisposeDelete}, false},
+		{"Keep oldest", "keep-oldest", "quarantine", workflow.ConflictPolicy{Strategy: workflow.ConflictKeepOldest, Disposal: workflow.DisposeQuarantine}, false},
+		{"Hardlink", "hardlink", "quarantine", workflow.ConflictPolicy{Strategy: workflow.ConflictHardlink, Disposal: workflow.DisposeQuarantine}, false},
+		{"Case insensitivity", "Keep-Oldest", "DELETE", workflow.ConflictPolicy{Strategy: workflow.ConflictKeepOldest, Disposal: workflow.DisposeDelete}, false},
+		{"Invalid strategy", "keep-newest", "quarantine", workflow.ConflictPolicy{}, true},
+		{"Invalid disposal", "keep-placed", "trash", workflow.ConflictPolicy{}, true},
+		{"Empty strategy", "", "quarantine", workflow.ConflictPolicy{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateConflictPolicy(tt.strategy, tt.disposal)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateConflictPolicy() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateConflictPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSourceDuplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		disposal  string
+		moveMode  bool
+		want      workflow.DuplicateDisposal
+		expectErr bool
+	}{
+		{"Keep when copying", "keep", false, workflow.DisposeKeep, false},
+		{"Keep when moving", "keep", true, workflow.DisposeKeep, false},
+		{"Quarantine when moving", "quarantine", true, workflow.DisposeQuarantine, false},
+		{"Delete when moving", "Delete", true, workflow.DisposeDelete, false},
+		{"Quarantine when copying", "quarantine", false, "", true},
+		{"Delete when copying", "delete", false, "", true},
+		{"Invalid value", "trash", true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateSourceDuplicates(tt.disposal, tt.moveMode)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateSourceDuplicates() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateSourceDuplicates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateApplyLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		workers     int
+		perDevice   int
+		spaceMargin string
+		want        workflow.ApplyLimits
+		expectErr   bool
+	}{
+		{"Sequential", 1, 1, "", workflow.ApplyLimits{Workers: 1, PerDevice: 1}, false},
+		{"Parallel", 8, 2, "", workflow.ApplyLimits{Workers: 8, PerDevice: 2}, false},
+		{"No device limit", 4, 0, "", workflow.ApplyLimits{Workers: 4, PerDevice: 0}, false},
+		{"Space margin", 4, 1, "1GB", workflow.ApplyLimits{Workers: 4, PerDevice: 1, SpaceMargin: 1 << 30}, false},
+		{"No space margin", 4, 1, "0", workflow.ApplyLimits{Workers: 4, PerDevice: 1}, false},
+		{"No workers", 0, 1, "", workflow.ApplyLimits{}, true},
+		{"Negative device limit", 4, -1, "", workflow.ApplyLimits{}, true},
+		{"Invalid space margin", 4, 1, "plenty", workflow.ApplyLimits{}, true},
+		{"Negative space margin", 4, 1, "-1GB", workflow.ApplyLimits{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateApplyLimits(tt.workers, tt.perDevice, tt.spaceMargin)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateApplyLimits() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateApplyLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		quiet     bool
+		verbose   bool
+		want      output
+		expectErr bool
+	}{
+		{"Default", "", false, false, output{format: "text", level: slog.LevelInfo}, false},
+		{"Text", "text", false, false, output{format: "text", level: slog.LevelInfo}, false},
+		{"JSON", "JSON", false, false, output{format: "json", level: slog.LevelInfo}, false},
+		{"Quiet", "text", true, false, output{format: "text", level: slog.LevelWarn}, false},
+		{"Verbose", "json", false, true, output{format: "json", level: slog.LevelDebug}, false},
+		{"Quiet and verbose", "text", true, true, output{}, true},
+		{"Invalid format", "xml", false, false, output{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateOutput(tt.format, tt.quiet, tt.verbose)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateOutput() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScanLimits(t *testing.T) {
+	roots := []string{"/media/card", "/mnt/nas/"}
+	tests := []struct {
+		name        string
+		scanWorkers int
+		hashWorkers int
+		rootWorkers string
+		bandwidth   string
+		want        workflow.ScanLimits
+		expectErr   bool
+	}{
+		{"Defaults", 4, 0, "", "", workflow.ScanLimits{ScanWorkers: 4}, false},
+		{"Worker counts", 2, 16, "", "", workflow.ScanLimits{ScanWorkers: 2, HashWorkers: 16}, false},
+		{"Root workers", 4, 0, "/mnt/nas=2, /media/card=8", "", workflow.ScanLimits{ScanWorkers: 4, RootWorkers: map[string]int{"/mnt/nas": 2, "/media/card": 8}}, false},
+		{"Bandwidth", 4, 0, "", "50MB", workflow.ScanLimits{ScanWorkers: 4, BytesPerSecond: 50 * 1024 * 1024}, false},
+		{"Fractional bandwidth", 4, 0, "", "1.5 kb", workflow.ScanLimits{ScanWorkers: 4, BytesPerSecond: 1536}, false},
+		{"Bandwidth in bytes", 4, 0, "", "4096", workflow.ScanLimits{ScanWorkers: 4, BytesPerSecond: 4096}, false},
+		{"No scan workers", 0, 0, "", "", workflow.ScanLimits{}, true},
+		{"Negative hash workers", 4, -1, "", "", workflow.ScanLimits{}, true},
+		{"Root workers without count", 4, 0, "/mnt/nas", "", workflow.ScanLimits{}, true},
+		{"Root workers with zero count", 4, 0, "/mnt/nas=0", "", workflow.ScanLimits{}, true},
+		{"Root workers for unknown root", 4, 0, "/tmp=2", "", workflow.ScanLimits{}, true},
+		{"Invalid bandwidth", 4, 0, "", "fast", workflow.ScanLimits{}, true},
+		{"Zero bandwidth", 4, 0, "", "0MB", workflow.ScanLimits{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateScanLimits(tt.scanWorkers, tt.hashWorkers, tt.rootWorkers, tt.bandwidth, roots)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateScanLimits() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateScanLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDedupeAction(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		want      workflow.DedupeAction
+		expectErr bool
+	}{
+		{"List", "list", workflow.DedupeList, false},
+		{"Link", "link", workflow.DedupeLink, false},
+		{"Quarantine", "Quarantine", workflow.DedupeQuarantine, false},
+		{"Delete", " delete ", workflow.DedupeDelete, false},
+		{"Invalid value", "trash", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateDedupeAction(tt.action)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateDedupeAction() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateDedupeAction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateKeeperRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      string
+		want      workflow.KeeperRule
+		expectErr bool
+	}{
+		{"Placed", "placed", workflow.KeepPlaced, false},
+		{"Oldest", "OLDEST", workflow.KeepOldest, false},
+		{"First root", "first-root", workflow.KeepFirstRoot, false},
+		{"Invalid value", "newest", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateKeeperRule(tt.rule)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateKeeperRule() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("validateKeeperRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  settings
+		want      importArgs
+		expectErr bool
+	}{
+		{"Empty", settings{}, importArgs{}, false},
+		{"Long option names", settings{"day-starts-at": "04:00", "move": true, "apply-workers": int64(2)}, importArgs{planOptions: planOptions{organiseOptions: organiseOptions{layoutOptions: layoutOptions{DayStartsAt: "04:00"}, MoveMode: true}}, applyOptions: applyOptions{ApplyWorkers: 2}}, false},
+		{"Positional arguments", settings{"sources": "/a,/b", "destination": "/c"}, importArgs{planOptions: planOptions{Sources: "/a,/b", Destination: "/c"}}, false},
+		{"List", settings{"sources": []any{"/a", "/b"}, "filter": []any{"jpg"}}, importArgs{planOptions: planOptions{Sources: "/a,/b", organiseOptions: organiseOptions{selectOptions: selectOptions{Filter: "jpg"}}}}, false},
+		{"Unknown setting", settings{"colour": "red"}, importArgs{}, true},
+		{"Short option name", settings{"m": true}, importArgs{}, true},
+		{"Profile", settings{"profile": "card"}, importArgs{}, true},
+		{"Wrong type", settings{"move": "yes"}, importArgs{}, true},
+		{"List of numbers", settings{"filter": []any{int64(1)}}, importArgs{}, true},
+		{"Date", settings{"since": time.Date(2024, 5, 4, 0, 0, 0, 0, time.FixedZone("date-local", 0))}, importArgs{planOptions: planOptions{organiseOptions: organiseOptions{Since: "2024-05-04"}}}, false},
+		{"Date and time", settings{"until": time.Date(2024, 5, 4, 18, 0, 0, 0, time.FixedZone("datetime-local", 0))}, importArgs{planOptions: planOptions{organiseOptions: organiseOptions{Until: "2024-05-04T18:00:00"}}}, false},
+		{"Confirm delete", settings{"confirm-delete": true}, importArgs{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got importArgs
+			err := applySettings(&got, tt.settings, userConfigDenied)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("applySettings() error = %v, expectErr %v", err, tt.expectErr)
+				return
+			}
+			if !tt.expectErr && got != tt.want {
+				t.Errorf("applySettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySettingsOfOtherCommands(t *testing.T) {
+	var got resumeArgs
+	err := applySettings(&got, settings{"destination": "/c", "move": true, "space-margin": "5GB"}, userConfigDenied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := resumeArgs{Destination: "/c", applyOptions: applyOptions{SpaceMargin: "5GB"}}
+	if got != want {
+		t.Errorf("applySettings() = %v, want %v", got, want)
+	}
+}
+
+func TestApplySettingsOfDestinationConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  settings
+		expectErr bool
+	}{
+		{"Allowed", settings{"filter": "jpg", "nosooc": true}, false},
+		{"Move", settings{"move": true}, true},
+		{"Confirm delete", settings{"confirm-delete": true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got importArgs
+			err := applySettings(&got, tt.settings, destinationConfigDenied)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("applySettings() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+func TestValidateMounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []string
+		expectErr bool
+	}{
+		{"Single directory", "/media/me", []string{"/media/me"}, false},
+		{"Multiple directories", "/media/me, /mnt", []string{"/media/me", "/mnt"}, false},
+		{"Empty entry", "/media/me,,/mnt", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateMounts(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("validateMounts() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("validateMounts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDefaultCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline []string
+		want    []string
+	}{
+		{"No command", []string{"/src", "/dst"}, []string{"import", "/src", "/dst"}},
+		{"Options without command", []string{"-f", "jpg", "/src", "/dst"}, []string{"import", "-f", "jpg", "/src", "/dst"}},
+		{"Empty", []string{}, []string{"import"}},
+		{"Command", []string{"plan", "/src", "/dst"}, []string{"plan", "/src", "/dst"}},
+		{"Profile before command", []string{"--profile", "card", "undo", "journal"}, []string{"--profile", "card", "undo", "journal"}},
+		{"Profile without command", []string{"-p", "card"}, []string{"import", "-p", "card"}},
+		{"Output options before command", []string{"-q", "--log-format", "json", "resume", "/dst"}, []string{"-q", "--log-format", "json", "resume", "/dst"}},
+		{"Output options without command", []string{"--log-format=json", "--verbose", "/src", "/dst"}, []string{"import", "--log-format=json", "--verbose", "/src", "/dst"}},
+		{"Help", []string{"--help"}, []string{"--help"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withDefaultCommand(tt.cmdline)
+			if !equalSlices(got, tt.want) {
+				t.Errorf("withDefaultCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func equalSlices(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -1,12 +1,34 @@
 package media
 
-import "sync"
+import (
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
 
 type File interface {
 	GetPath() string
 	GetFingerprint() string
 	SetFingerprint(fingerprint string)
 	GetDestinationPath(base string) (string, error)
+	GetCaptureTime() (time.Time, error)
+	// Reads the capture time from the already opened file, so it doesn't have
+	// to be opened again when the capture time is needed
+	LoadCaptureTime(r io.ReadSeeker) (time.Time, error)
+}
+
+// Implemented by media that records the camera it was captured with. Both are
+// read together with the capture time.
+type CameraFile interface {
+	// Returns the model of the camera, empty when the file doesn't record it
+	GetCamera() string
+	// Returns the model of the lens, empty when the file doesn't record it
+	GetLens() string
 }
 
 type (
@@ -18,6 +40,8 @@ const (
 	JpgMedia MediaType = "jpg"
 	RafMedia MediaType = "raf"
 	MovMedia MediaType = "mov"
+	// Same container as mov, read the same way
+	Mp4Media MediaType = "mp4"
 	photos   mediaLoc  = "photos"
 	videos   mediaLoc  = "videos"
 )
@@ -34,3 +58,41 @@ func (lp *LazyPath) GetDestinationPath(compute func() (string, error)) (string,
 	})
 	return lp.path, lp.err
 }
+
+type LazyTime struct {
+	err  error
+	t    time.Time
+	once sync.Once
+}
+
+func (lt *LazyTime) GetCaptureTime(compute func() (time.Time, error)) (time.Time, error) {
+	lt.once.Do(func() {
+		lt.t, lt.err = compute()
+	})
+	return lt.t, lt.err
+}
+
+// Returns the dated directory for media captured at creationTime. Captures made
+// before dayStartsAt are filed under the previous day so that late-night events
+// are not split across two folders.
+func datedDir(base string, loc mediaLoc, creationTime time.Time, dayStartsAt time.Duration) string {
+	day := creationTime.Add(-dayStartsAt)
+	date := day.Format("2006-01-02")
+	year := strconv.Itoa(day.Year())
+
+	return filepath.Join(base, string(loc), year, date)
+}
+
+// Returns the value of a text field of the EXIF data, e.g. the camera model,
+// empty when it isn't set.
+func exifText(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
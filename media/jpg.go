@@ -4,26 +4,31 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"path/filepath"
-	"strconv"
+	"time"
 
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
-func NewJpg(path string, noSooc bool) *Jpg {
+func NewJpg(fsys storage.FS, path string, noSooc bool, dayStartsAt time.Duration) *Jpg {
 	if path == "" {
 		panic("path not set for media file")
 	}
 
-	return &Jpg{Path: path, noSooc: noSooc}
+	return &Jpg{fsys: fsys, Path: path, noSooc: noSooc, dayStartsAt: dayStartsAt}
 }
 
 type Jpg struct {
+	fsys        storage.FS
 	Path        string
 	fingerprint string
 	lazy        LazyPath
+	lazyTime    LazyTime
+	camera      string
+	lens        string
 	noSooc      bool
+	dayStartsAt time.Duration
 }
 
 func (j *Jpg) GetPath() string {
@@ -38,37 +43,75 @@ func (j *Jpg) SetFingerprint(fingerprint string) {
 	j.fingerprint = fingerprint
 }
 
-func (j *Jpg) GetDestinationPath(base string) (string, error) {
-	return j.lazy.GetDestinationPath(
-		func() (string, error) {
-			f, err := os.Open(j.Path)
+func (j *Jpg) GetCaptureTime() (time.Time, error) {
+	return j.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			f, err := j.fsys.Open(j.Path)
 			if err != nil {
-				return "", err
+				return time.Time{}, err
 			}
 			defer f.Close()
 
-			exif, err := exif.Decode(f)
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					return "", errors.New("exif data not found")
-				} else {
-					return "", fmt.Errorf("failed to decode exif data: %w", err)
-				}
-			}
+			return j.readCaptureTime(f)
+		})
+}
+
+func (j *Jpg) LoadCaptureTime(r io.ReadSeeker) (time.Time, error) {
+	return j.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			return j.readCaptureTime(r)
+		})
+}
+
+func (j *Jpg) readCaptureTime(r io.ReadSeeker) (time.Time, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	exifData, err := exif.Decode(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return time.Time{}, errors.New("exif data not found")
+		} else {
+			return time.Time{}, fmt.Errorf("failed to decode exif data: %w", err)
+		}
+	}
 
-			creationTime, err := exif.DateTime()
+	j.camera = exifText(exifData, exif.Model)
+	j.lens = exifText(exifData, exif.LensModel)
+
+	creationTime, err := exifData.DateTime()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get creation time: %w", err)
+	}
+
+	return creationTime, nil
+}
+
+func (j *Jpg) GetCamera() string {
+	j.GetCaptureTime()
+	return j.camera
+}
+
+func (j *Jpg) GetLens() string {
+	j.GetCaptureTime()
+	return j.lens
+}
+
+func (j *Jpg) GetDestinationPath(base string) (string, error) {
+	return j.lazy.GetDestinationPath(
+		func() (string, error) {
+			creationTime, err := j.GetCaptureTime()
 			if err != nil {
-				return "", fmt.Errorf("failed to get creation time: %w", err)
+				return "", err
 			}
 
-			date := creationTime.Format("2006-01-02")
-			year := strconv.Itoa(creationTime.Year())
-
 			subFolder := "sooc"
 			if j.noSooc {
 				subFolder = ""
 			}
-			mediaHome := filepath.Join(base, string(photos), year, date, subFolder)
+			mediaHome := filepath.Join(datedDir(base, photos, creationTime, j.dayStartsAt), subFolder)
 			return filepath.Join(mediaHome, filepath.Base(j.Path)), nil
 		})
 }
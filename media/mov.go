@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"os"
+	"io"
 	"path/filepath"
-	"strconv"
 	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 )
 
 const (
@@ -19,87 +20,114 @@ const (
 	compressedMovieAtomType = "cmov"
 )
 
-func NewMov(path string) *Mov {
+func NewMov(fsys storage.FS, path string, dayStartsAt time.Duration) *Mov {
 	if path == "" {
 		panic("path not set for media file")
 	}
 
-	return &Mov{Path: path}
+	return &Mov{fsys: fsys, Path: path, dayStartsAt: dayStartsAt}
 }
 
 type Mov struct {
+	fsys        storage.FS
 	Path        string
 	fingerprint string
 	lazy        LazyPath
+	lazyTime    LazyTime
+	dayStartsAt time.Duration
 }
 
 func (m *Mov) GetPath() string {
 	return m.Path
 }
 
-func (m *Mov) GetDestinationPath(base string) (string, error) {
-	return m.lazy.GetDestinationPath(
-		func() (string, error) {
-			file, err := os.Open(m.Path)
+func (m *Mov) GetCaptureTime() (time.Time, error) {
+	return m.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			file, err := m.fsys.Open(m.Path)
 			if err != nil {
-				return "", err
+				return time.Time{}, err
 			}
 			defer file.Close()
 
-			buf := make([]byte, 8)
-
-			// Traverse videoBuffer to find movieResourceAtom
-			for {
-				// bytes 1-4 is atom size, 5-8 is type
-				// Read atom
-				if _, err := file.Read(buf); err != nil {
-					return "", err
-				}
-
-				if bytes.Equal(buf[4:8], []byte(movieResourceAtomType)) {
-					break // found it!
-				}
-
-				atomSize := binary.BigEndian.Uint32(buf) // check size of atom
-				if atomSize < 8 {
-					return "", errors.New("invalid atom size")
-				}
-				file.Seek(int64(atomSize)-8, 1) // jump over data and set seeker at beginning of next atom
-			}
+			return m.readCaptureTime(file)
+		})
+}
+
+func (m *Mov) LoadCaptureTime(r io.ReadSeeker) (time.Time, error) {
+	return m.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			return m.readCaptureTime(r)
+		})
+}
+
+func (m *Mov) readCaptureTime(r io.ReadSeeker) (time.Time, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-			// read next atom
-			if _, err := file.Read(buf); err != nil {
+	buf := make([]byte, 8)
+
+	// Traverse videoBuffer to find movieResourceAtom
+	for {
+		// bytes 1-4 is atom size, 5-8 is type
+		// Read atom
+		if _, err := r.Read(buf); err != nil {
+			return time.Time{}, err
+		}
+
+		if bytes.Equal(buf[4:8], []byte(movieResourceAtomType)) {
+			break // found it!
+		}
+
+		atomSize := binary.BigEndian.Uint32(buf) // check size of atom
+		if atomSize < 8 {
+			return time.Time{}, errors.New("invalid atom size")
+		}
+		r.Seek(int64(atomSize)-8, io.SeekCurrent) // jump over data and set seeker at beginning of next atom
+	}
+
+	// read next atom
+	if _, err := r.Read(buf); err != nil {
+		return time.Time{}, err
+	}
+
+	atomType := string(buf[4:8]) // skip size and read type
+	switch atomType {
+	case movieHeaderAtomType:
+		// read next atom
+		if _, err := r.Read(buf); err != nil {
+			return time.Time{}, err
+		}
+
+		creationTimeValue := binary.BigEndian.Uint32(buf[4:])
+		if creationTimeValue == 0 {
+			return time.Time{}, errors.New("creation time not set in metadata")
+		}
+		// byte 1 is version, byte 2-4 is flags, 5-8 Creation time
+		appleEpoch := int64(creationTimeValue) // Read creation time
+
+		return time.Unix(appleEpoch-appleEpochAdjustment, 0).Local(), nil
+	case compressedMovieAtomType:
+		return time.Time{}, errors.New("compressed video")
+	case referenceMovieAtomType:
+		return time.Time{}, errors.New("reference video")
+	default:
+		return time.Time{}, errors.New("did not find movie header atom (mvhd)")
+	}
+}
+
+func (m *Mov) GetDestinationPath(base string) (string, error) {
+	return m.lazy.GetDestinationPath(
+		func() (string, error) {
+			creationTime, err := m.GetCaptureTime()
+			if err != nil {
 				return "", err
 			}
 
-			atomType := string(buf[4:8]) // skip size and read type
-			switch atomType {
-			case movieHeaderAtomType:
-				// read next atom
-				if _, err := file.Read(buf); err != nil {
-					return "", err
-				}
-
-				creationTimeValue := binary.BigEndian.Uint32(buf[4:])
-				if creationTimeValue == 0 {
-					return "", errors.New("creation time not set in metadata")
-				}
-				// byte 1 is version, byte 2-4 is flags, 5-8 Creation time
-				appleEpoch := int64(creationTimeValue) // Read creation time
-
-				creationTime := time.Unix(appleEpoch-appleEpochAdjustment, 0).Local()
-				date := creationTime.Format("2006-01-02")
-				year := strconv.Itoa(creationTime.Year())
-
-				mediaHome := filepath.Join(base, string(videos), year, date)
-				return filepath.Join(mediaHome, filepath.Base(m.Path)), nil
-			case compressedMovieAtomType:
-				return "", errors.New("compressed video")
-			case referenceMovieAtomType:
-				return "", errors.New("reference video")
-			default:
-				return "", errors.New("did not find movie header atom (mvhd)")
-			}
+			mediaHome := datedDir(base, videos, creationTime, m.dayStartsAt)
+			return filepath.Join(mediaHome, filepath.Base(m.Path)), nil
 		})
 }
 
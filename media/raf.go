@@ -6,25 +6,30 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"path/filepath"
-	"strconv"
+	"time"
 
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
-func NewRaf(path string) *Raf {
+func NewRaf(fsys storage.FS, path string, dayStartsAt time.Duration) *Raf {
 	if path == "" {
 		panic("path not set for media file")
 	}
 
-	return &Raf{Path: path}
+	return &Raf{fsys: fsys, Path: path, dayStartsAt: dayStartsAt}
 }
 
 type Raf struct {
+	fsys        storage.FS
 	Path        string
 	fingerprint string
 	lazy        LazyPath
+	lazyTime    LazyTime
+	camera      string
+	lens        string
+	dayStartsAt time.Duration
 
 	Header struct {
 		Magic         [16]byte
@@ -62,43 +67,95 @@ func (r *Raf) SetFingerprint(fingerprint string) {
 	r.fingerprint = fingerprint
 }
 
-func (r *Raf) GetDestinationPath(base string) (string, error) {
-	return r.lazy.GetDestinationPath(
-		func() (string, error) {
-			f, err := os.Open(r.Path)
+func (r *Raf) GetCaptureTime() (time.Time, error) {
+	return r.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			f, err := r.fsys.Open(r.Path)
 			if err != nil {
-				return "", err
+				return time.Time{}, err
 			}
 			defer f.Close()
 
-			err = binary.Read(f, binary.BigEndian, &r.Header)
-			if err != nil {
-				return "", fmt.Errorf("failed to read RAF header: %w", err)
-			}
+			return r.readCaptureTime(f)
+		})
+}
 
-			jbuf := make([]byte, r.Header.Dir.Jpeg.Len)
-			_, err = f.ReadAt(jbuf, int64(r.Header.Dir.Jpeg.Idx))
-			if err != nil {
-				return "", fmt.Errorf("failed to read JPEG data: %w", err)
-			}
-			exifData, err := exif.Decode(bytes.NewReader(jbuf))
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					return "", errors.New("exif data not found")
-				} else {
-					return "", fmt.Errorf("failed to decode exif data: %w", err)
-				}
-			}
+func (r *Raf) LoadCaptureTime(rs io.ReadSeeker) (time.Time, error) {
+	return r.lazyTime.GetCaptureTime(
+		func() (time.Time, error) {
+			return r.readCaptureTime(rs)
+		})
+}
+
+func (r *Raf) readCaptureTime(rs io.ReadSeeker) (time.Time, error) {
+	_, err := rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	err = binary.Read(rs, binary.BigEndian, &r.Header)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read RAF header: %w", err)
+	}
+
+	// Files that only look like RAF, e.g. resource forks macOS leaves on cards,
+	// would have a buffer of any size allocated for the preview
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return time.Time{}, err
+	}
+	jpeg := r.Header.Dir.Jpeg
+	if jpeg.Idx < 0 || jpeg.Len < 0 || int64(jpeg.Idx)+int64(jpeg.Len) > size {
+		return time.Time{}, fmt.Errorf("failed to read JPEG data: %w", io.ErrUnexpectedEOF)
+	}
+
+	jbuf := make([]byte, jpeg.Len)
+	_, err = rs.Seek(int64(jpeg.Idx), io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(rs, jbuf)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read JPEG data: %w", err)
+	}
+	exifData, err := exif.Decode(bytes.NewReader(jbuf))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return time.Time{}, errors.New("exif data not found")
+		} else {
+			return time.Time{}, fmt.Errorf("failed to decode exif data: %w", err)
+		}
+	}
+
+	r.camera = exifText(exifData, exif.Model)
+	r.lens = exifText(exifData, exif.LensModel)
+
+	creationTime, err := exifData.DateTime()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get creation time: %w", err)
+	}
+
+	return creationTime, nil
+}
+
+func (r *Raf) GetCamera() string {
+	r.GetCaptureTime()
+	return r.camera
+}
+
+func (r *Raf) GetLens() string {
+	r.GetCaptureTime()
+	return r.lens
+}
 
-			creationTime, err := exifData.DateTime()
+func (r *Raf) GetDestinationPath(base string) (string, error) {
+	return r.lazy.GetDestinationPath(
+		func() (string, error) {
+			creationTime, err := r.GetCaptureTime()
 			if err != nil {
-				return "", fmt.Errorf("failed to get creation time: %w", err)
+				return "", err
 			}
 
-			date := creationTime.Format("2006-01-02")
-			year := strconv.Itoa(creationTime.Year())
-
-			mediaHome := filepath.Join(base, string(photos), year, date)
+			mediaHome := datedDir(base, photos, creationTime, r.dayStartsAt)
 			return filepath.Join(mediaHome, filepath.Base(r.Path)), nil
 		})
 }
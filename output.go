@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/andrius-ordojan/shutter-pilot/workflow"
+)
+
+const (
+	textFormat = "text"
+	jsonFormat = "json"
+)
+
+var allowedLogFormats = []string{textFormat, jsonFormat}
+
+// How the events of a run are printed.
+type output struct {
+	format string
+	// Events below the level are left out
+	level slog.Level
+}
+
+func validateOutput(format string, quiet, verbose bool) (output, error) {
+	if quiet && verbose {
+		return output{}, errors.New("--quiet and --verbose can not be used together")
+	}
+
+	o := output{format: strings.ToLower(strings.TrimSpace(format)), level: slog.LevelInfo}
+	if o.format == "" {
+		o.format = textFormat
+	}
+	if !slices.Contains(allowedLogFormats, o.format) {
+		return output{}, fmt.Errorf("invalid log format: %s. Allowed formats are: %s", format, strings.Join(allowedLogFormats, ", "))
+	}
+
+	if quiet {
+		o.level = slog.LevelWarn
+	}
+	if verbose {
+		o.level = slog.LevelDebug
+	}
+
+	return o, nil
+}
+
+// Returns the sink that prints the events of a run to stdout.
+func (o output) sink() workflow.EventSink {
+	if o.format == jsonFormat {
+		return workflow.NewJSONSink(os.Stdout, o.level)
+	}
+	return workflow.NewTextSink(os.Stdout, o.level)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// File system of a server or bucket that is mounted next to the local disk.
+type remote interface {
+	storage.FS
+	Root() string
+}
+
+// Returns the file system the paths of a run are on. The servers of sftp://
+// paths and the buckets of s3:// paths are connected to and mounted next to
+// the local disk, so it has to be closed once the run is done.
+func openStorage(paths ...string) (*storage.Mux, error) {
+	fsys := storage.NewMux(storage.OS{})
+	for _, path := range paths {
+		if fsys.Mounted(path) {
+			continue
+		}
+
+		var r remote
+		var err error
+		switch {
+		case storage.IsSFTP(path):
+			r, err = storage.DialSFTP(path)
+		case storage.IsS3(path):
+			r, err = storage.DialS3(path)
+		default:
+			continue
+		}
+		if err != nil {
+			fsys.Close()
+			return nil, err
+		}
+		fsys.Mount(r.Root(), r)
+	}
+	return fsys, nil
+}
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+	errClosed   = errors.New("file already closed")
+	errReadOnly = errors.New("file opened for reading")
+	errNotRead  = errors.New("file opened for writing")
+)
+
+// File system kept in memory, for tests that should not touch the disk. Hard
+// links share their contents and every file is on the same device. The root
+// directory of the OS, e.g. /, always exists.
+type Mem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	free  uint64
+}
+
+// File or directory, shared by the paths that are hard links of it.
+type memNode struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+func NewMem() *Mem {
+	return &Mem{nodes: make(map[string]*memNode), free: math.MaxUint64}
+}
+
+// Writes the file with the data, creating its parent directories.
+func (m *Mem) WriteFile(name string, data []byte, modTime time.Time) error {
+	err := m.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if n, ok := m.nodes[name]; ok && n.dir {
+		return &fs.PathError{Op: "write", Path: name, Err: errIsDir}
+	}
+	m.nodes[name] = &memNode{data: slices.Clone(data), modTime: modTime}
+	return nil
+}
+
+// Returns the contents of the file.
+func (m *Mem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.file("read", filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(n.data), nil
+}
+
+// Sets the bytes FreeSpace reports, no limit is put on the files written.
+func (m *Mem) SetFreeSpace(free uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.free = free
+}
+
+// Returns the node at the cleaned path. The root always exists.
+func (m *Mem) lookup(name string) (*memNode, bool) {
+	if isRoot(name) {
+		return &memNode{dir: true}, true
+	}
+	n, ok := m.nodes[name]
+	return n, ok
+}
+
+func isRoot(name string) bool {
+	return filepath.Dir(name) == name || name == "."
+}
+
+func (m *Mem) file(op, name string) (*memNode, error) {
+	n, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if n.dir {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errIsDir}
+	}
+	return n, nil
+}
+
+// Checks that the parent directory of the path exists.
+func (m *Mem) checkParent(op, name string) error {
+	parent, ok := m.lookup(filepath.Dir(name))
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.dir {
+		return &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return nil
+}
+
+func (m *Mem) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, err := m.file("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{fs: m, name: name, node: n, readable: true}, nil
+}
+
+func (m *Mem) Create(name string) (File, error) {
+	return m.openWriter("create", name, true)
+}
+
+func (m *Mem) Append(name string) (File, error) {
+	return m.openWriter("append", name, false)
+}
+
+func (m *Mem) openWriter(op, name string, truncate bool) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+
+	n, ok := m.lookup(name)
+	switch {
+	case !ok:
+		err := m.checkParent(op, name)
+		if err != nil {
+			return nil, err
+		}
+		n = &memNode{modTime: time.Now()}
+		m.nodes[name] = n
+	case n.dir:
+		return nil, &fs.PathError{Op: op, Path: name, Err: errIsDir}
+	case truncate:
+		n.data = nil
+		n.modTime = time.Now()
+	}
+
+	return &memFile{fs: m, name: name, node: n, readable: truncate, writable: true, appending: !truncate}, nil
+}
+
+func (m *Mem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memInfo{name: filepath.Base(name), node: n, size: int64(len(n.data))}, nil
+}
+
+func (m *Mem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	var entries []fs.DirEntry
+	for path, child := range m.nodes {
+		if filepath.Dir(path) == name && path != name {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: filepath.Base(path), node: child, size: int64(len(child.data))}))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *Mem) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(filepath.Clean(name))
+}
+
+func (m *Mem) mkdirAll(name string) error {
+	n, ok := m.lookup(name)
+	if ok {
+		if !n.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+
+	err := m.mkdirAll(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (m *Mem) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	n, ok := m.lookup(oldname)
+	if !ok || isRoot(oldname) {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	err := m.checkParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	if target, ok := m.lookup(newname); ok && target.dir {
+		return &fs.PathError{Op: "rename", Path: newname, Err: errIsDir}
+	}
+	if oldname == newname {
+		return nil
+	}
+
+	// A directory takes everything under it along
+	if n.dir {
+		prefix := oldname + string(filepath.Separator)
+		if strings.HasPrefix(newname, prefix) {
+			return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+		}
+		moved := make(map[string]*memNode)
+		for path, child := range m.nodes {
+			if strings.HasPrefix(path, prefix) {
+				delete(m.nodes, path)
+				moved[filepath.Join(newname, strings.TrimPrefix(path, prefix))] = child
+			}
+		}
+		for path, child := range moved {
+			m.nodes[path] = child
+		}
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = n
+	return nil
+}
+
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+
+	n, ok := m.lookup(name)
+	if !ok || isRoot(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.dir {
+		for path := range m.nodes {
+			if filepath.Dir(path) == name {
+				return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *Mem) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	n, err := m.file("link", oldname)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.lookup(newname); ok {
+		return &fs.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	err = m.checkParent("link", newname)
+	if err != nil {
+		return err
+	}
+	m.nodes[newname] = n
+	return nil
+}
+
+func (m *Mem) SameFile(a, b fs.FileInfo) bool {
+	ai, ok := a.(memInfo)
+	if !ok {
+		return false
+	}
+	bi, ok := b.(memInfo)
+	if !ok {
+		return false
+	}
+	return ai.node == bi.node
+}
+
+func (m *Mem) DeviceID(name string, info fs.FileInfo) string {
+	return "mem"
+}
+
+func (m *Mem) FreeSpace(name string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.free, nil
+}
+
+type memInfo struct {
+	name string
+	node *memNode
+	size int64
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.node.modTime }
+func (i memInfo) IsDir() bool        { return i.node.dir }
+func (i memInfo) Sys() any           { return i.node }
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.node.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+type memFile struct {
+	fs        *Mem
+	name      string
+	node      *memNode
+	offset    int64
+	readable  bool
+	writable  bool
+	appending bool
+	closed    bool
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errClosed}
+	}
+	if !f.readable {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errNotRead}
+	}
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errReadOnly}
+	}
+
+	if f.appending {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], b)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return memInfo{name: filepath.Base(f.name), node: f.node, size: int64(len(f.node.data))}, nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: errClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var errCrossDevice = errors.New("file systems differ")
+
+// Paths of a remote file system start with the scheme of a URL, e.g.
+// sftp://nas. A single letter before the colon is a Windows drive.
+var remotePath = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]+:[/\\]`)
+
+// Reports whether the path is on a remote file system.
+func IsRemote(name string) bool {
+	return remotePath.MatchString(name)
+}
+
+// Like filepath.Abs, but paths of remote file systems are returned unchanged
+// since they are absolute already.
+func Abs(name string) (string, error) {
+	if IsRemote(name) {
+		return filepath.Clean(name), nil
+	}
+	return filepath.Abs(name)
+}
+
+// Mux sends each call to the file system mounted at the root the path starts
+// with, paths under no root go to the local file system. This lets a plan move
+// files from a card on the local disk to a server. Renames and links between
+// two file systems fail like ones between devices, so files are copied instead.
+type Mux struct {
+	local  FS
+	mounts []mount
+}
+
+type mount struct {
+	root string
+	fsys FS
+}
+
+func NewMux(local FS) *Mux {
+	return &Mux{local: local}
+}
+
+// Mounts the file system at root, e.g. sftp://user@nas. Paths under the root
+// are passed on as slash separated absolute paths of the file system.
+func (m *Mux) Mount(root string, fsys FS) {
+	m.mounts = append(m.mounts, mount{root: filepath.Clean(root), fsys: fsys})
+}
+
+// Reports whether a file system is mounted at a root the path is under.
+func (m *Mux) Mounted(name string) bool {
+	_, _, ok := m.find(name)
+	return ok
+}
+
+func (m *Mux) find(name string) (FS, string, bool) {
+	name = filepath.Clean(name)
+
+	var match *mount
+	for i, mnt := range m.mounts {
+		if name != mnt.root && !strings.HasPrefix(name, mnt.root+string(filepath.Separator)) {
+			continue
+		}
+		if match == nil || len(mnt.root) > len(match.root) {
+			match = &m.mounts[i]
+		}
+	}
+	if match == nil {
+		return nil, "", false
+	}
+
+	rest := filepath.ToSlash(strings.TrimPrefix(name, match.root))
+	if rest == "" {
+		rest = "/"
+	}
+	return match.fsys, rest, true
+}
+
+func (m *Mux) route(name string) (FS, string) {
+	if fsys, rest, ok := m.find(name); ok {
+		return fsys, rest
+	}
+	return m.local, name
+}
+
+func (m *Mux) Open(name string) (File, error) {
+	fsys, name := m.route(name)
+	return fsys.Open(name)
+}
+
+func (m *Mux) Create(name string) (File, error) {
+	fsys, name := m.route(name)
+	return fsys.Create(name)
+}
+
+func (m *Mux) Append(name string) (File, error) {
+	fsys, name := m.route(name)
+	return fsys.Append(name)
+}
+
+func (m *Mux) Stat(name string) (fs.FileInfo, error) {
+	fsys, name := m.route(name)
+	return fsys.Stat(name)
+}
+
+func (m *Mux) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys, name := m.route(name)
+	return fsys.ReadDir(name)
+}
+
+func (m *Mux) MkdirAll(name string, perm fs.FileMode) error {
+	fsys, name := m.route(name)
+	return fsys.MkdirAll(name, perm)
+}
+
+func (m *Mux) Rename(oldname, newname string) error {
+	oldFS, oldRest := m.route(oldname)
+	newFS, newRest := m.route(newname)
+	if oldFS != newFS {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errCrossDevice}
+	}
+	return oldFS.Rename(oldRest, newRest)
+}
+
+func (m *Mux) Remove(name string) error {
+	fsys, name := m.route(name)
+	return fsys.Remove(name)
+}
+
+func (m *Mux) Link(oldname, newname string) error {
+	oldFS, oldRest := m.route(oldname)
+	newFS, newRest := m.route(newname)
+	if oldFS != newFS {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errCrossDevice}
+	}
+	return oldFS.Link(oldRest, newRest)
+}
+
+func (m *Mux) SameFile(a, b fs.FileInfo) bool {
+	if m.local.SameFile(a, b) {
+		return true
+	}
+	for _, mnt := range m.mounts {
+		if mnt.fsys.SameFile(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mux) DeviceID(name string, info fs.FileInfo) string {
+	fsys, rest := m.route(name)
+	return fsys.DeviceID(rest, info)
+}
+
+func (m *Mux) FreeSpace(name string) (uint64, error) {
+	fsys, name := m.route(name)
+	return fsys.FreeSpace(name)
+}
+
+// Returns an empty fingerprint for files of file systems that don't keep them.
+func (m *Mux) Fingerprint(name string) (string, error) {
+	fsys, name := m.route(name)
+	if store, ok := fsys.(FingerprintStore); ok {
+		return store.Fingerprint(name)
+	}
+	return "", nil
+}
+
+func (m *Mux) CreatesAtomically(name string) bool {
+	fsys, name := m.route(name)
+	c, ok := fsys.(AtomicCreator)
+	return ok && c.CreatesAtomically(name)
+}
+
+// Closes the mounted file systems that hold connections.
+func (m *Mux) Close() error {
+	var errs []error
+	for _, mnt := range m.mounts {
+		if c, ok := mnt.fsys.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
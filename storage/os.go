@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+)
+
+// File system of the operating system.
+type OS struct{}
+
+func (OS) Open(name string) (File, error) {
+	return openFile(name, os.O_RDONLY, 0)
+}
+
+func (OS) Create(name string) (File, error) {
+	return openFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (OS) Append(name string) (File, error) {
+	return openFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// Returns a nil interface instead of a nil *os.File when the file can't be opened.
+func openFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OS) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (OS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OS) SameFile(a, b fs.FileInfo) bool {
+	return os.SameFile(a, b)
+}
+
+func (OS) DeviceID(name string, info fs.FileInfo) string {
+	return deviceID(name, info)
+}
+
+func (OS) FreeSpace(name string) (uint64, error) {
+	return freeSpace(name)
+}
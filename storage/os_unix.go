@@ -0,0 +1,33 @@
+//go:build !windows
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+func deviceID(path string, info fs.FileInfo) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprint(uint64(stat.Dev))
+	}
+	return path
+}
+
+// Returns the bytes available to the user on the filesystem of the path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// Reports whether the rename failed because the file would have to move to
+// another device or file system.
+func IsCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, errCrossDevice)
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Returned by MoveFile when the file would have to be moved to another volume
+const errorNotSameDevice = syscall.Errno(17)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func deviceID(path string, info fs.FileInfo) string {
+	return strings.ToUpper(filepath.VolumeName(path))
+}
+
+// Returns the bytes available to the user on the volume of the path.
+func freeSpace(path string) (uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ok == 0 {
+		return 0, err
+	}
+	return available, nil
+}
+
+// Reports whether the rename failed because the file would have to move to
+// another device or file system.
+func IsCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice) || errors.Is(err, errCrossDevice)
+}
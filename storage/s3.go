@@ -0,0 +1,466 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3Scheme        = "s3"
+	s3DefaultServer = "s3.amazonaws.com"
+	// Large enough for files of 160 GB with the 10000 parts an upload can have,
+	// small enough to keep a part in memory
+	s3PartSize = 16 * 1024 * 1024
+	// Metadata of uploaded objects with the fingerprint of the file
+	fingerprintMetadata = "Fingerprint"
+)
+
+// File system of a bucket in S3 or a compatible server like MinIO. Paths are
+// the keys of the objects with a leading slash, directories are the prefixes
+// the keys share, so they exist as long as there are objects in them. Uploads
+// keep the fingerprint of the file as metadata, renames are copies made by
+// the server.
+type S3 struct {
+	// Scheme and bucket, e.g. s3://photos
+	root   string
+	bucket string
+	client *minio.Client
+}
+
+// Uses a connected client for the bucket.
+func NewS3(client *minio.Client, bucket string) *S3 {
+	return &S3{root: s3Scheme + "://" + bucket, bucket: bucket, client: client}
+}
+
+// Reports whether the path is an s3:// URL.
+func IsS3(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), s3Scheme+"://")
+}
+
+// Connects to the bucket of an s3://bucket/prefix URL. The server is the one
+// in AWS_ENDPOINT_URL, e.g. http://localhost:9000 for MinIO, or AWS when it is
+// not set. Credentials are read from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY or ~/.aws/credentials, the region from AWS_REGION.
+func DialS3(rawURL string) (*S3, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 url %s: %w", rawURL, err)
+	}
+	if !strings.EqualFold(u.Scheme, s3Scheme) || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 url %s: expected s3://bucket/path", rawURL)
+	}
+
+	server, secure := s3DefaultServer, true
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %s: expected e.g. http://localhost:9000", endpoint)
+		}
+		server, secure = e.Host, e.Scheme != "http"
+	}
+
+	client, err := minio.New(server, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.EnvMinio{},
+		}),
+		Secure: secure,
+		Region: os.Getenv("AWS_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", server, err)
+	}
+
+	exists, err := client.BucketExists(context.Background(), u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find bucket %s on %s: %w", u.Host, server, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist on %s", u.Host, server)
+	}
+
+	return NewS3(client, u.Host), nil
+}
+
+// Returns the URL the bucket is mounted at in a Mux.
+func (s *S3) Root() string {
+	return s.root
+}
+
+func objectKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (s *S3) fail(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: s.root + name, Err: err}
+}
+
+func (s *S3) Open(name string) (File, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, objectKey(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.fail("open", name, err)
+	}
+
+	// Objects are only fetched once they are used
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s.fail("open", name, err)
+	}
+	return &s3Reader{Object: obj, info: newObjectInfo(info)}, nil
+}
+
+func (s *S3) Create(name string) (File, error) {
+	return &s3Writer{s3: s, name: name, done: make(chan error, 1)}, nil
+}
+
+// Objects can't be added to, so the object is read and uploaded again
+// whenever the file is synced.
+func (s *S3) Append(name string) (File, error) {
+	a := &s3Appender{s3: s, name: name}
+
+	f, err := s.Open(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		_, err = a.data.ReadFrom(f)
+		if err != nil {
+			return nil, s.fail("append", name, err)
+		}
+	}
+	return a, nil
+}
+
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	key := objectKey(name)
+	if key == "" {
+		return objectInfo{name: s.bucket, dir: true}, nil
+	}
+
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return newObjectInfo(info), nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return nil, s.fail("stat", name, err)
+	}
+
+	isDir, err := s.hasObjects(key)
+	if err != nil {
+		return nil, s.fail("stat", name, err)
+	}
+	if !isDir {
+		return nil, s.fail("stat", name, fs.ErrNotExist)
+	}
+	return objectInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (s *S3) hasObjects(key string) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Prefixes without objects are listed as empty directories, so a library can
+// be started under a new prefix.
+func (s *S3) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := objectKey(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, s.fail("readdir", name, obj.Err)
+		}
+		if obj.Key == prefix {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(newObjectInfo(obj)))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// Directories don't have to be made, they exist once objects are put in them.
+func (s *S3) MkdirAll(name string, perm fs.FileMode) error {
+	return nil
+}
+
+func (s *S3) Rename(oldname, newname string) error {
+	ctx := context.Background()
+	_, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: objectKey(newname)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: objectKey(oldname)},
+	)
+	if err != nil {
+		return s.fail("rename", oldname, err)
+	}
+	return s.fail("rename", oldname, s.client.RemoveObject(ctx, s.bucket, objectKey(oldname), minio.RemoveObjectOptions{}))
+}
+
+// Removing an object that doesn't exist succeeds in S3, so it is looked up
+// first to fail like other file systems do.
+func (s *S3) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return s.fail("remove", name, errNotEmpty)
+	}
+	return s.fail("remove", name, s.client.RemoveObject(context.Background(), s.bucket, objectKey(name), minio.RemoveObjectOptions{}))
+}
+
+func (s *S3) Link(oldname, newname string) error {
+	return s.fail("link", newname, errors.ErrUnsupported)
+}
+
+func (s *S3) SameFile(a, b fs.FileInfo) bool {
+	return false
+}
+
+// The bucket is counted as one device.
+func (s *S3) DeviceID(name string, info fs.FileInfo) string {
+	return s.root
+}
+
+// Buckets have no size limit to report.
+func (s *S3) FreeSpace(name string) (uint64, error) {
+	return 0, s.fail("statvfs", name, errors.ErrUnsupported)
+}
+
+// Objects only exist once their upload is complete.
+func (s *S3) CreatesAtomically(name string) bool {
+	return true
+}
+
+// Returns the fingerprint kept in the metadata of the object, objects that
+// were not uploaded by shutter-pilot have none.
+func (s *S3) Fingerprint(name string) (string, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, objectKey(name), minio.StatObjectOptions{})
+	if err != nil {
+		return "", s.fail("stat", name, err)
+	}
+	return info.Metadata.Get("X-Amz-Meta-" + fingerprintMetadata), nil
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// Listed prefixes end with a slash and are directories.
+func newObjectInfo(info minio.ObjectInfo) objectInfo {
+	return objectInfo{
+		name:    path.Base(info.Key),
+		size:    info.Size,
+		modTime: info.LastModified,
+		dir:     strings.HasSuffix(info.Key, "/"),
+	}
+}
+
+func (i objectInfo) Name() string       { return i.name }
+func (i objectInfo) Size() int64        { return i.size }
+func (i objectInfo) ModTime() time.Time { return i.modTime }
+func (i objectInfo) IsDir() bool        { return i.dir }
+func (i objectInfo) Sys() any           { return nil }
+
+func (i objectInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// Object opened for reading, reads after a seek are ranged requests.
+type s3Reader struct {
+	*minio.Object
+	info objectInfo
+}
+
+// The end of the object is reported by a read of its own, like files of the OS
+// do, as the media readers take an error to mean nothing was read.
+func (r *s3Reader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	if n > 0 && err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+func (r *s3Reader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *s3Reader) Write(p []byte) (int, error) {
+	return 0, errReadOnly
+}
+
+func (r *s3Reader) Sync() error {
+	return nil
+}
+
+// Object being uploaded. The contents are streamed to the server in parts,
+// the object only exists once the file is closed.
+type s3Writer struct {
+	s3          *S3
+	name        string
+	fingerprint string
+	pipe        *io.PipeWriter
+	size        int64
+	done        chan error
+	closed      bool
+}
+
+func (w *s3Writer) SetFingerprint(fingerprint string) {
+	w.fingerprint = fingerprint
+}
+
+func (w *s3Writer) start() {
+	if w.pipe != nil {
+		return
+	}
+
+	var reader *io.PipeReader
+	reader, w.pipe = io.Pipe()
+
+	opts := minio.PutObjectOptions{PartSize: s3PartSize}
+	if w.fingerprint != "" {
+		opts.UserMetadata = map[string]string{fingerprintMetadata: w.fingerprint}
+	}
+	go func() {
+		_, err := w.s3.client.PutObject(context.Background(), w.s3.bucket, objectKey(w.name), reader, -1, opts)
+		// Stops writes when the upload failed
+		reader.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	w.start()
+	n, err := w.pipe.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	w.start()
+	w.pipe.Close()
+	return w.s3.fail("upload", w.name, <-w.done)
+}
+
+// Fails the upload, the object is not created.
+func (w *s3Writer) Abort(err error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	w.start()
+	w.pipe.CloseWithError(err)
+	<-w.done
+}
+
+func (w *s3Writer) Read(p []byte) (int, error) {
+	return 0, errNotRead
+}
+
+func (w *s3Writer) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	return objectInfo{name: path.Base(w.name), size: w.size, modTime: time.Now()}, nil
+}
+
+// The contents are stored once the file is closed.
+func (w *s3Writer) Sync() error {
+	return nil
+}
+
+// Object that is written in full by every sync, used for the small journals
+// and checkpoints that grow line by line.
+type s3Appender struct {
+	s3    *S3
+	name  string
+	data  bytes.Buffer
+	dirty bool
+}
+
+func (a *s3Appender) Write(p []byte) (int, error) {
+	a.dirty = true
+	return a.data.Write(p)
+}
+
+func (a *s3Appender) Sync() error {
+	if !a.dirty {
+		return nil
+	}
+
+	_, err := a.s3.client.PutObject(context.Background(), a.s3.bucket, objectKey(a.name), bytes.NewReader(a.data.Bytes()), int64(a.data.Len()), minio.PutObjectOptions{})
+	if err != nil {
+		return a.s3.fail("upload", a.name, err)
+	}
+	a.dirty = false
+	return nil
+}
+
+func (a *s3Appender) Close() error {
+	return a.Sync()
+}
+
+func (a *s3Appender) Read(p []byte) (int, error) {
+	return 0, errNotRead
+}
+
+func (a *s3Appender) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (a *s3Appender) Stat() (fs.FileInfo, error) {
+	return objectInfo{name: path.Base(a.name), size: int64(a.data.Len()), modTime: time.Now()}, nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpScheme      = "sftp"
+	sftpDefaultPort = "22"
+	sftpDialTimeout = 30 * time.Second
+)
+
+// Private keys tried when the ssh agent can't log in, in the order ssh uses them.
+var defaultKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// File system of a server reached over SFTP. Paths are the absolute paths on
+// the server, renames and hard links are done by the server so files don't
+// travel over the network twice.
+type SFTP struct {
+	// Scheme and host of the server, e.g. sftp://user@nas
+	root   string
+	client *sftp.Client
+	// Connection the client runs on, nil when the client was passed in
+	conn *ssh.Client
+}
+
+// Uses a connected client, root is the URL the files are reported under.
+func NewSFTP(client *sftp.Client, root string) *SFTP {
+	return &SFTP{root: strings.TrimSuffix(root, "/"), client: client}
+}
+
+// Reports whether the path is an sftp:// URL.
+func IsSFTP(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), sftpScheme+"://")
+}
+
+// Connects to the server of an sftp://user@host:port/path URL. The user
+// defaults to the current one and the port to 22. It logs in with the keys of
+// the ssh agent or the default keys in ~/.ssh, and the server has to be listed
+// in ~/.ssh/known_hosts like it has to be for ssh.
+func DialSFTP(rawURL string) (*SFTP, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp url %s: %w", rawURL, err)
+	}
+	if !strings.EqualFold(u.Scheme, sftpScheme) || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid sftp url %s: expected sftp://user@host/path", rawURL)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("invalid sftp url %s: passwords are not supported, log in with a key", rawURL)
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user for %s: %w", rawURL, err)
+		}
+		username = current.Username
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts, connect to %s with ssh once to add it: %w", u.Hostname(), err)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = sftpDefaultPort
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(u.Hostname(), port), &ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods(home),
+		HostKeyCallback: hostKeys,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", u.Host, err)
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %w", u.Host, err)
+	}
+
+	root := &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}
+	s := NewSFTP(client, root.String())
+	s.conn = conn
+	return s, nil
+}
+
+func authMethods(home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range defaultKeyFiles {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys with a passphrase are left to the agent
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return methods
+}
+
+// Returns the URL the server is mounted at in a Mux.
+func (s *SFTP) Root() string {
+	return s.root
+}
+
+func (s *SFTP) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		err = errors.Join(err, s.conn.Close())
+	}
+	return err
+}
+
+func (s *SFTP) fail(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: s.root + name, Err: err}
+}
+
+func (s *SFTP) Open(name string) (File, error) {
+	return s.openFile("open", name, os.O_RDONLY)
+}
+
+func (s *SFTP) Create(name string) (File, error) {
+	return s.openFile("create", name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+func (s *SFTP) Append(name string) (File, error) {
+	return s.openFile("append", name, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+func (s *SFTP) openFile(op, name string, flag int) (File, error) {
+	f, err := s.client.OpenFile(name, flag)
+	if err != nil {
+		return nil, s.fail(op, name, err)
+	}
+	return sftpFile{f}, nil
+}
+
+func (s *SFTP) Stat(name string) (fs.FileInfo, error) {
+	info, err := s.client.Stat(name)
+	return info, s.fail("stat", name, err)
+}
+
+func (s *SFTP) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := s.client.ReadDir(name)
+	if err != nil {
+		return nil, s.fail("readdir", name, err)
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// The permissions are left to the umask of the server.
+func (s *SFTP) MkdirAll(name string, perm fs.FileMode) error {
+	return s.fail("mkdir", name, s.client.MkdirAll(name))
+}
+
+func (s *SFTP) Rename(oldname, newname string) error {
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.fail("rename", oldname, s.client.PosixRename(oldname, newname))
+	}
+
+	// Plain SFTP renames refuse to replace a file
+	err := s.client.Remove(newname)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return s.fail("rename", oldname, err)
+	}
+	return s.fail("rename", oldname, s.client.Rename(oldname, newname))
+}
+
+func (s *SFTP) Remove(name string) error {
+	return s.fail("remove", name, s.client.Remove(name))
+}
+
+func (s *SFTP) Link(oldname, newname string) error {
+	if _, ok := s.client.HasExtension("hardlink@openssh.com"); !ok {
+		return s.fail("link", newname, errors.ErrUnsupported)
+	}
+	return s.fail("link", newname, s.client.Link(oldname, newname))
+}
+
+// SFTP does not tell which file an inode belongs to, so files are never
+// reported to be the same.
+func (s *SFTP) SameFile(a, b fs.FileInfo) bool {
+	return false
+}
+
+// All files of the server are counted as one device, the connection is what
+// limits the transfers.
+func (s *SFTP) DeviceID(name string, info fs.FileInfo) string {
+	return s.root
+}
+
+// Fails with errors.ErrUnsupported when the server can't tell.
+func (s *SFTP) FreeSpace(name string) (uint64, error) {
+	if _, ok := s.client.HasExtension("statvfs@openssh.com"); !ok {
+		return 0, s.fail("statvfs", name, errors.ErrUnsupported)
+	}
+
+	stat, err := s.client.StatVFS(path.Clean(name))
+	if err != nil {
+		return 0, s.fail("statvfs", name, err)
+	}
+	return stat.Bavail * stat.Frsize, nil
+}
+
+type sftpFile struct {
+	*sftp.File
+}
+
+// Servers without the fsync extension are trusted to keep what they were sent.
+func (f sftpFile) Sync() error {
+	err := f.File.Sync()
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+// Package storage is the file system media is read from and organised in. The
+// OS file system is the local disk, SFTP a server reached over SSH, Mem keeps
+// files in memory for tests. S3 keeps files as objects of a bucket. Mux combines
+// them by path.
+package storage
+
+import (
+	"io"
+	"io/fs"
+)
+
+// File system media is read from and organised in. Paths are in the format of
+// the operating system, errors wrap fs.ErrNotExist and fs.ErrExist like the ones
+// of the os package.
+type FS interface {
+	// Opens the file for reading
+	Open(name string) (File, error)
+	// Creates the file for writing, truncating it when it exists
+	Create(name string) (File, error)
+	// Opens the file for writing at its end, creating it when it is missing
+	Append(name string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// Lists the directory sorted by name, walking a tree is done with it
+	ReadDir(name string) ([]fs.DirEntry, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	// Renames the file, replacing the file at newname. Renames to another device
+	// fail with an error IsCrossDevice reports.
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	// Creates newname as a hard link to oldname
+	Link(oldname, newname string) error
+	// Reports whether both describe the same file, e.g. hard links of one file
+	SameFile(a, b fs.FileInfo) bool
+	// Returns an ID of the device the file is on, the same for files on the same
+	// device
+	DeviceID(name string, info fs.FileInfo) string
+	// Returns the bytes available to the user on the file system of the path,
+	// errors.ErrUnsupported when the file system can't tell
+	FreeSpace(name string) (uint64, error)
+}
+
+// Open file of a file system.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	// Commits the contents to storage
+	Sync() error
+}
+
+// Implemented by file systems that keep the fingerprint of a file with it, e.g.
+// in the metadata of an object, so the file doesn't have to be read again to be
+// compared.
+type FingerprintStore interface {
+	// Returns the fingerprint kept with the file, empty when there is none
+	Fingerprint(name string) (string, error)
+}
+
+// Implemented by the created files of a FingerprintStore. The fingerprint has
+// to be set before the contents are written.
+type FingerprintWriter interface {
+	SetFingerprint(fingerprint string)
+}
+
+// Implemented by file systems whose created files only appear once they are
+// complete, e.g. objects of a bucket, which exist once their upload is done.
+// Copies to them are written to their path straight away instead of under a
+// temporary name.
+type AtomicCreator interface {
+	// Reports whether files created at the path only appear once complete
+	CreatesAtomically(name string) bool
+}
+
+// Implemented by the created files of an AtomicCreator. Aborting discards what
+// was written, so nothing appears at the path.
+type Aborter interface {
+	Abort(err error)
+}
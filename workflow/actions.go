@@ -7,26 +7,61 @@ import (
 	"path/filepath"
 
 	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 )
 
-type (
-	actionType string
-)
+// Kind of change an action makes. Skip, conflict and duplicate actions only
+// report a file and leave it where it is.
+type ActionType string
+
+// Action of a plan. Paths are the ones the plan was built with.
+type Action struct {
+	Type ActionType `json:"type"`
+	// File the action operates on
+	Path        string `json:"path"`
+	Fingerprint string `json:"fingerprint"`
+	// Path the file ends up at, set for actions that relocate or duplicate it
+	Target string `json:"target,omitempty"`
+	// Files the action relates to, e.g. the kept copy of a duplicate or the rest of a conflict
+	Others []string `json:"others,omitempty"`
+	// Destination path of the kept copy whose import the action waits for
+	ImportedAt string `json:"importedAt,omitempty"`
+	// Deletion was explicitly approved by the user
+	Confirmed bool   `json:"confirmed,omitempty"`
+	Summary   string `json:"summary"`
+}
+
+const partialFileSuffix = ".partial"
 
 const (
-	move     actionType = "move"
-	copy     actionType = "copy"
-	skip     actionType = "skip"
-	conflict actionType = "conflict"
+	ActionMove       ActionType = "move"
+	ActionCopy       ActionType = "copy"
+	ActionSkip       ActionType = "skip"
+	ActionConflict   ActionType = "conflict"
+	ActionDelete     ActionType = "delete"
+	ActionQuarantine ActionType = "quarantine"
+	ActionLink       ActionType = "link"
+	ActionDuplicate  ActionType = "duplicate"
 )
 
 type action struct {
-	execute func() (string, error)
+	// Reports the bytes it copies to the progress, which can be nil
+	execute func(progress *progress) (string, error)
 	summery func() string
-	aType   actionType
+	// Path the file ends up at, set for actions that relocate or duplicate it
+	target func() (string, error)
+	aType  ActionType
+	// File the action operates on
+	file media.File
+	// Files the action relates to, e.g. the kept copy of a duplicate or the rest of a conflict
+	others []media.File
+	// Deletion was explicitly approved by the user
+	confirmed bool
+	// Kept copy whose import the action waits for
+	imported media.File
 }
 
-func newMoveAction(file media.File, destinationDir string) action {
+func newMoveAction(fsys storage.FS, file media.File, destinationDir string) action {
 	if file.GetPath() == "" {
 		panic("path not set for media file")
 	}
@@ -35,22 +70,26 @@ func newMoveAction(file media.File, destinationDir string) action {
 	}
 
 	return action{
-		aType: move,
-		execute: func() (string, error) {
+		aType: ActionMove,
+		file:  file,
+		target: func() (string, error) {
+			return file.GetDestinationPath(destinationDir)
+		},
+		execute: func(progress *progress) (string, error) {
 			dstPath, err := file.GetDestinationPath(destinationDir)
 			if err != nil {
 				return "", fmt.Errorf("%s %w", file.GetPath(), err)
 			}
 
 			dstDir := filepath.Dir(dstPath)
-			if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-				err := os.MkdirAll(dstDir, os.ModePerm)
+			if _, err := fsys.Stat(dstDir); os.IsNotExist(err) {
+				err := fsys.MkdirAll(dstDir, os.ModePerm)
 				if err != nil {
 					return "", err
 				}
 			}
 
-			err = os.Rename(file.GetPath(), dstPath)
+			err = moveFile(fsys, file.GetPath(), dstPath, file.GetFingerprint(), progress)
 			if err != nil {
 				return "", err
 			}
@@ -68,7 +107,7 @@ func newMoveAction(file media.File, destinationDir string) action {
 	}
 }
 
-func newCopyAction(file media.File, destinationDir string) action {
+func newCopyAction(fsys storage.FS, file media.File, destinationDir string) action {
 	if file.GetPath() == "" {
 		panic("path not set for media file")
 	}
@@ -77,41 +116,28 @@ func newCopyAction(file media.File, destinationDir string) action {
 	}
 
 	return action{
-		aType: copy,
-		execute: func() (string, error) {
+		aType: ActionCopy,
+		file:  file,
+		target: func() (string, error) {
+			return file.GetDestinationPath(destinationDir)
+		},
+		execute: func(progress *progress) (string, error) {
 			dstPath, err := file.GetDestinationPath(destinationDir)
 			if err != nil {
 				return "", fmt.Errorf("%s %w", file.GetPath(), err)
 			}
 
 			dstDir := filepath.Dir(dstPath)
-			if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-				err := os.MkdirAll(dstDir, os.ModePerm)
+			if _, err := fsys.Stat(dstDir); os.IsNotExist(err) {
+				err := fsys.MkdirAll(dstDir, os.ModePerm)
 				if err != nil {
 					return "", err
 				}
 			}
 
-			sourceFile, err := os.Open(file.GetPath())
-			if err != nil {
-				return "", fmt.Errorf("failed to open source file: %w", err)
-			}
-			defer sourceFile.Close()
-
-			destinationFile, err := os.Create(dstPath)
-			if err != nil {
-				return "", fmt.Errorf("failed to create destination file: %w", err)
-			}
-			defer destinationFile.Close()
-
-			_, err = io.Copy(destinationFile, sourceFile)
+			err = copyFile(fsys, file.GetPath(), dstPath, file.GetFingerprint(), progress)
 			if err != nil {
-				return "", fmt.Errorf("failed to copy content: %w", err)
-			}
-
-			err = destinationFile.Sync()
-			if err != nil {
-				return "", fmt.Errorf("failed to sync destination file: %w", err)
+				return "", err
 			}
 
 			return fmt.Sprintf("Copying from %s to %s", file.GetPath(), dstPath), nil
@@ -127,6 +153,77 @@ func newCopyAction(file media.File, destinationDir string) action {
 	}
 }
 
+// Renames the file, or copies it and removes the original when it is moved to
+// another device.
+func moveFile(fsys storage.FS, srcPath, dstPath, fingerprint string, progress *progress) error {
+	err := fsys.Rename(srcPath, dstPath)
+	if !storage.IsCrossDevice(err) {
+		return err
+	}
+
+	err = copyFile(fsys, srcPath, dstPath, fingerprint, progress)
+	if err != nil {
+		return err
+	}
+	return fsys.Remove(srcPath)
+}
+
+// Copies the file under a temporary name and only gives it its final name once
+// the contents are synced, so an interrupted copy never leaves an incomplete
+// file at the destination path. File systems whose files only appear once
+// complete are written to the destination path straight away, which saves
+// buckets copying every object a second time. File systems that keep
+// fingerprints store it with the copy.
+func copyFile(fsys storage.FS, srcPath, dstPath, fingerprint string, progress *progress) error {
+	sourceFile, err := fsys.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer sourceFile.Close()
+
+	partialPath := dstPath + partialFileSuffix
+	if c, ok := fsys.(storage.AtomicCreator); ok && c.CreatesAtomically(dstPath) {
+		partialPath = dstPath
+	}
+	destinationFile, err := fsys.Create(partialPath)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer destinationFile.Close()
+	if w, ok := destinationFile.(storage.FingerprintWriter); ok {
+		w.SetFingerprint(fingerprint)
+	}
+
+	_, err = io.Copy(destinationFile, progress.reader(sourceFile))
+	if err != nil {
+		if a, ok := destinationFile.(storage.Aborter); ok {
+			a.Abort(err)
+		}
+		return fmt.Errorf("failed to copy content: %w", err)
+	}
+
+	err = destinationFile.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync destination file: %w", err)
+	}
+
+	// Open files can't be renamed on every platform
+	err = destinationFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close destination file: %w", err)
+	}
+
+	if partialPath == dstPath {
+		return nil
+	}
+	err = fsys.Rename(partialPath, dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename destination file: %w", err)
+	}
+
+	return nil
+}
+
 func newSkipAction(source, destination media.File) action {
 	if source.GetPath() == "" {
 		panic("path not set for source media file")
@@ -136,8 +233,10 @@ func newSkipAction(source, destination media.File) action {
 	}
 
 	return action{
-		aType: skip,
-		execute: func() (string, error) {
+		aType:  ActionSkip,
+		file:   source,
+		others: []media.File{destination},
+		execute: func(*progress) (string, error) {
 			return fmt.Sprintf("Skipping %s", source.GetPath()), nil
 		},
 		summery: func() string {
@@ -152,8 +251,10 @@ func newConflictAction(conflictedFiles []media.File) action {
 	}
 
 	return action{
-		aType: conflict,
-		execute: func() (string, error) {
+		aType:  ActionConflict,
+		file:   conflictedFiles[0],
+		others: conflictedFiles[1:],
+		execute: func(*progress) (string, error) {
 			return "conflict", nil
 		},
 		summery: func() string {
@@ -166,3 +267,174 @@ func newConflictAction(conflictedFiles []media.File) action {
 		},
 	}
 }
+
+func newDeleteAction(fsys storage.FS, file media.File, reason string) action {
+	if file.GetPath() == "" {
+		panic("path not set for media file")
+	}
+
+	return action{
+		aType: ActionDelete,
+		file:  file,
+		execute: func(*progress) (string, error) {
+			err := fsys.Remove(file.GetPath())
+			if err != nil {
+				return "", fmt.Errorf("failed to delete file: %w", err)
+			}
+
+			return fmt.Sprintf("Deleting %s", file.GetPath()), nil
+		},
+		summery: func() string {
+			return fmt.Sprintf("Delete: %s (%s)", file.GetPath(), reason)
+		},
+	}
+}
+
+// Moves the file to the quarantine directory of rootDir, the directory it was found in.
+func newQuarantineAction(fsys storage.FS, file, keeper media.File, rootDir string) action {
+	if file.GetPath() == "" {
+		panic("path not set for media file")
+	}
+	if keeper.GetPath() == "" {
+		panic("path not set for kept media file")
+	}
+	if rootDir == "" {
+		panic("root dir not set")
+	}
+
+	return quarantineActionTo(fsys, file, keeper, func() (string, error) {
+		relPath, err := filepath.Rel(rootDir, file.GetPath())
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(rootDir, stateDirName, quarantineDirName, relPath), nil
+	})
+}
+
+func quarantineActionTo(fsys storage.FS, file, keeper media.File, quarantinePath func() (string, error)) action {
+	return action{
+		aType:  ActionQuarantine,
+		file:   file,
+		others: []media.File{keeper},
+		target: quarantinePath,
+		execute: func(*progress) (string, error) {
+			dstPath, err := quarantinePath()
+			if err != nil {
+				return "", fmt.Errorf("%s %w", file.GetPath(), err)
+			}
+
+			if _, err := fsys.Stat(dstPath); err == nil {
+				return "", fmt.Errorf("quarantined file already exists at %s", dstPath)
+			}
+
+			err = fsys.MkdirAll(filepath.Dir(dstPath), os.ModePerm)
+			if err != nil {
+				return "", err
+			}
+
+			err = fsys.Rename(file.GetPath(), dstPath)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("Quarantining %s to %s", file.GetPath(), dstPath), nil
+		},
+		summery: func() string {
+			dstPath, err := quarantinePath()
+			if err != nil {
+				dstPath = "unkown"
+			}
+
+			return fmt.Sprintf("Quarantine: %s to %s (duplicate of %s)", file.GetPath(), dstPath, keeper.GetPath())
+		},
+	}
+}
+
+func newLinkAction(fsys storage.FS, file, keeper media.File) action {
+	if file.GetPath() == "" {
+		panic("path not set for media file")
+	}
+	if keeper.GetPath() == "" {
+		panic("path not set for kept media file")
+	}
+
+	return action{
+		aType:  ActionLink,
+		file:   file,
+		others: []media.File{keeper},
+		execute: func(*progress) (string, error) {
+			keeperInfo, err := fsys.Stat(keeper.GetPath())
+			if err != nil {
+				return "", err
+			}
+			fileInfo, err := fsys.Stat(file.GetPath())
+			if err != nil {
+				return "", err
+			}
+			if fsys.SameFile(keeperInfo, fileInfo) {
+				return fmt.Sprintf("Already linked %s to %s", file.GetPath(), keeper.GetPath()), nil
+			}
+
+			// Link next to the duplicate first and rename over it, so the duplicate
+			// is never gone without the link being in place.
+			tmpPath := file.GetPath() + ".shutter-pilot-link"
+			err = fsys.Link(keeper.GetPath(), tmpPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to create hard link: %w", err)
+			}
+
+			err = fsys.Rename(tmpPath, file.GetPath())
+			if err != nil {
+				fsys.Remove(tmpPath)
+				return "", fmt.Errorf("failed to replace duplicate with hard link: %w", err)
+			}
+
+			return fmt.Sprintf("Linking %s to %s", file.GetPath(), keeper.GetPath()), nil
+		},
+		summery: func() string {
+			return fmt.Sprintf("Link: %s to %s (duplicate)", file.GetPath(), keeper.GetPath())
+		},
+	}
+}
+
+func newDuplicateAction(file, kept media.File) action {
+	if file.GetPath() == "" {
+		panic("path not set for media file")
+	}
+	if kept.GetPath() == "" {
+		panic("path not set for kept media file")
+	}
+
+	return action{
+		aType:  ActionDuplicate,
+		file:   file,
+		others: []media.File{kept},
+		execute: func(*progress) (string, error) {
+			return fmt.Sprintf("Ignoring duplicate %s", file.GetPath()), nil
+		},
+		summery: func() string {
+			return fmt.Sprintf("Duplicate: %s (has the same contents as %s)", file.GetPath(), kept.GetPath())
+		},
+	}
+}
+
+// Guards an action so it only runs once the contents of imported are in the
+// library, at its destination path and intact.
+func afterImport(fsys storage.FS, a action, imported media.File, destinationDir string) action {
+	a.imported = imported
+	execute := a.execute
+	a.execute = func(progress *progress) (string, error) {
+		dstPath, err := imported.GetDestinationPath(destinationDir)
+		if err != nil {
+			return "", fmt.Errorf("%s %w", imported.GetPath(), err)
+		}
+
+		err = checkFingerprint(fsys, dstPath, imported.GetFingerprint())
+		if err != nil {
+			return "", fmt.Errorf("%s is not imported: %s %w", a.file.GetPath(), dstPath, err)
+		}
+
+		return execute(progress)
+	}
+	return a
+}
@@ -0,0 +1,60 @@
+package workflow
+
+import (
+	"strings"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+)
+
+// Picks the source files to organise by when and with what they were captured.
+type captureFilter struct {
+	// Captures before it are left out, when set
+	since time.Time
+	// Captures at or after it are left out, when set
+	until time.Time
+	// Cameras to keep the captures of, all of them when empty
+	cameras []string
+}
+
+// Reports whether the file is organised. Files without the metadata a filter
+// needs are left out, e.g. videos when filtering by camera since their camera
+// isn't read.
+func (f captureFilter) keeps(file media.File) bool {
+	if !f.since.IsZero() || !f.until.IsZero() {
+		captured, err := file.GetCaptureTime()
+		if err != nil {
+			return false
+		}
+		if !f.since.IsZero() && captured.Before(f.since) {
+			return false
+		}
+		if !f.until.IsZero() && !captured.Before(f.until) {
+			return false
+		}
+	}
+
+	if len(f.cameras) > 0 {
+		c, ok := file.(media.CameraFile)
+		if !ok {
+			return false
+		}
+		return matchCamera(f.cameras, c.GetCamera())
+	}
+	return true
+}
+
+// Cameras are matched without regard to case against any part of the model, so
+// "x-t4" matches X-T4 and "EOS R5" matches Canon EOS R5.
+func matchCamera(cameras []string, model string) bool {
+	if model == "" {
+		return false
+	}
+	model = strings.ToLower(model)
+	for _, camera := range cameras {
+		if strings.Contains(model, strings.ToLower(camera)) {
+			return true
+		}
+	}
+	return false
+}
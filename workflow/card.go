@@ -0,0 +1,126 @@
+package workflow
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Prefix of a source that is the root of a memory card, e.g. card:/media/card.
+// The directories the camera keeps media in are looked up on the card, so they
+// don't have to be listed one by one.
+const CardPrefix = "card:"
+
+// Folders in DCIM are numbered 100 to 999 and named with five more characters,
+// e.g. 100_FUJI. Anything else in DCIM belongs to the camera.
+var dcfDirName = regexp.MustCompile(`^[1-9][0-9]{2}[0-9A-Za-z_]{5}$`)
+
+// Directories of video formats that are kept next to DCIM, from the root of
+// the card. Thumbnails and proxies are in directories next to them and are
+// left out.
+var (
+	// Sony XAVC clips
+	m4rootClipDir = []string{"PRIVATE", "M4ROOT", "CLIP"}
+	// AVCHD streams of Sony, Panasonic and Canon camcorders
+	avchdStreamDir = []string{"PRIVATE", "AVCHD", "BDMV", "STREAM"}
+)
+
+// Reports whether the source is the root of a memory card.
+func IsCard(source string) bool {
+	return strings.HasPrefix(source, CardPrefix)
+}
+
+// Replaces the cards among the sources with the directories of media on them.
+func expandCards(fsys storage.FS, sources []string, events *emitter) ([]string, error) {
+	var expanded []string
+	for _, source := range sources {
+		if !IsCard(source) {
+			expanded = append(expanded, source)
+			continue
+		}
+
+		dirs, err := cardDirs(fsys, strings.TrimPrefix(source, CardPrefix), events)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, dirs...)
+	}
+	return expanded, nil
+}
+
+// Returns the directories of media on the card at root: the DCF folders in
+// DCIM and the clips of Sony video cameras. MISC only holds print orders and
+// transfer lists, so it is skipped like the rest of the card.
+func cardDirs(fsys storage.FS, root string, events *emitter) ([]string, error) {
+	var dirs []string
+
+	dcim, err := findDir(fsys, root, "DCIM")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card %s: %w", root, err)
+	}
+	if dcim != "" {
+		entries, err := fsys.ReadDir(dcim)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read card %s: %w", root, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && dcfDirName.MatchString(entry.Name()) {
+				dirs = append(dirs, filepath.Join(dcim, entry.Name()))
+			}
+		}
+	}
+
+	clips, err := findDir(fsys, root, m4rootClipDir...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card %s: %w", root, err)
+	}
+	if clips != "" {
+		dirs = append(dirs, clips)
+	}
+
+	streams, err := findDir(fsys, root, avchdStreamDir...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card %s: %w", root, err)
+	}
+	if streams != "" {
+		events.emit(Event{
+			Type:    EventWarning,
+			Message: fmt.Sprintf("Warning: AVCHD video in %s is not supported and is left on the card", streams),
+			Path:    streams,
+		})
+	}
+
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no media found on card %s, expected DCIM or PRIVATE/M4ROOT directories", root)
+	}
+	return dirs, nil
+}
+
+// Returns the path of the directory under root, matching the names without
+// regard to case since cards are formatted with FAT. The path is empty when
+// the directory doesn't exist.
+func findDir(fsys storage.FS, root string, names ...string) (string, error) {
+	dir := root
+	for _, name := range names {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+
+		found := ""
+		for _, entry := range entries {
+			if entry.IsDir() && strings.EqualFold(entry.Name(), name) {
+				found = filepath.Join(dir, entry.Name())
+				break
+			}
+		}
+		if found == "" {
+			return "", nil
+		}
+		dir = found
+	}
+	return dir, nil
+}
@@ -0,0 +1,394 @@
+package workflow
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+const checkpointFileName = "resume.jsonl"
+
+// Describes the action with everything needed to execute it again without
+// rescanning the files.
+func (p *Plan) recordAction(a action) (Action, error) {
+	r := Action{
+		Type:        a.aType,
+		Path:        a.file.GetPath(),
+		Fingerprint: a.file.GetFingerprint(),
+		Confirmed:   a.confirmed,
+		Summary:     a.summery(),
+	}
+
+	if a.target != nil {
+		target, err := a.target()
+		if err != nil {
+			return Action{}, fmt.Errorf("%s %w", a.file.GetPath(), err)
+		}
+		r.Target = target
+	}
+
+	for _, o := range a.others {
+		r.Others = append(r.Others, o.GetPath())
+	}
+
+	if a.imported != nil {
+		importedAt, err := a.imported.GetDestinationPath(p.destinationPath)
+		if err != nil {
+			return Action{}, fmt.Errorf("%s %w", a.imported.GetPath(), err)
+		}
+		r.ImportedAt = importedAt
+	}
+
+	return r, nil
+}
+
+func actionFromRecord(fsys storage.FS, r Action, destinationPath string) (action, error) {
+	file := &savedFile{path: r.Path, fingerprint: r.Fingerprint, destination: r.Target}
+
+	var others []media.File
+	for _, o := range r.Others {
+		others = append(others, &savedFile{path: o})
+	}
+
+	var a action
+	switch r.Type {
+	case ActionMove:
+		a = newMoveAction(fsys, file, destinationPath)
+	case ActionCopy:
+		a = newCopyAction(fsys, file, destinationPath)
+	case ActionDelete:
+		a = newDeleteAction(fsys, file, "")
+	case ActionSkip, ActionQuarantine, ActionLink, ActionDuplicate:
+		if len(others) == 0 {
+			return action{}, fmt.Errorf("%s action for %s is missing related files", r.Type, r.Path)
+		}
+
+		switch r.Type {
+		case ActionSkip:
+			a = newSkipAction(file, others[0])
+		case ActionQuarantine:
+			target := r.Target
+			a = quarantineActionTo(fsys, file, others[0], func() (string, error) { return target, nil })
+		case ActionLink:
+			a = newLinkAction(fsys, file, others[0])
+		case ActionDuplicate:
+			a = newDuplicateAction(file, others[0])
+		}
+	default:
+		return action{}, fmt.Errorf("%s action for %s can not be resumed", r.Type, r.Path)
+	}
+
+	if r.ImportedAt != "" {
+		imported := &savedFile{path: r.ImportedAt, fingerprint: r.Fingerprint, destination: r.ImportedAt}
+		a = afterImport(fsys, a, imported, destinationPath)
+	}
+	a.confirmed = r.Confirmed
+
+	summary := r.Summary
+	a.summery = func() string { return summary }
+
+	return a, nil
+}
+
+// Stand-in for a media file of a saved plan. Its destination was worked out
+// when the plan was created, so the file does not have to be read again.
+type savedFile struct {
+	path        string
+	fingerprint string
+	destination string
+}
+
+func (f *savedFile) GetPath() string {
+	return f.path
+}
+
+func (f *savedFile) GetFingerprint() string {
+	return f.fingerprint
+}
+
+func (f *savedFile) SetFingerprint(fingerprint string) {
+	f.fingerprint = fingerprint
+}
+
+func (f *savedFile) GetDestinationPath(base string) (string, error) {
+	if f.destination == "" {
+		return "", errors.New("destination not recorded in saved plan")
+	}
+	return f.destination, nil
+}
+
+func (f *savedFile) GetCaptureTime() (time.Time, error) {
+	return time.Time{}, errors.New("capture time not recorded in saved plan")
+}
+
+func (f *savedFile) LoadCaptureTime(r io.ReadSeeker) (time.Time, error) {
+	return f.GetCaptureTime()
+}
+
+// One line of the checkpoint file. The file starts with the journal of the run,
+// followed by the actions of the plan and then a line for every completed action.
+type checkpointLine struct {
+	Journal string  `json:"journal,omitempty"`
+	Action  *Action `json:"action,omitempty"`
+	Done    *int    `json:"done,omitempty"`
+}
+
+type checkpoint struct {
+	fsys storage.FS
+	path string
+	file storage.File
+}
+
+func checkpointPath(destinationPath string) string {
+	return filepath.Join(destinationPath, stateDirName, checkpointFileName)
+}
+
+func createCheckpoint(fsys storage.FS, destinationPath, journalPath string, records []Action) (*checkpoint, error) {
+	path := checkpointPath(destinationPath)
+	err := fsys.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	journalPath, err = storage.Abs(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fsys.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{fsys: fsys, path: path, file: file}
+	err = cp.write(checkpointLine{Journal: journalPath})
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+	for _, r := range records {
+		err = cp.write(checkpointLine{Action: &r})
+		if err != nil {
+			cp.close()
+			return nil, err
+		}
+	}
+
+	return cp, cp.file.Sync()
+}
+
+func openCheckpoint(fsys storage.FS, path string) (*checkpoint, error) {
+	file, err := fsys.Append(path)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{fsys: fsys, path: path, file: file}, nil
+}
+
+func (cp *checkpoint) write(line checkpointLine) error {
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = cp.file.Write(append(b, '\n'))
+	return err
+}
+
+func (cp *checkpoint) markDone(index int) error {
+	err := cp.write(checkpointLine{Done: &index})
+	if err != nil {
+		return err
+	}
+	return cp.file.Sync()
+}
+
+func (cp *checkpoint) close() error {
+	return cp.file.Close()
+}
+
+// Removes the checkpoint once the plan has been applied completely.
+func (cp *checkpoint) finish() error {
+	err := cp.close()
+	if err != nil {
+		return err
+	}
+	return cp.fsys.Remove(cp.path)
+}
+
+type savedPlan struct {
+	journal   string
+	records   []Action
+	completed map[int]bool
+}
+
+func readCheckpoint(fsys storage.FS, path string) (savedPlan, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return savedPlan{}, err
+	}
+	defer f.Close()
+
+	saved := savedPlan{completed: make(map[int]bool)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*oneKB), oneMB)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var line checkpointLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			// The last line is incomplete when the run was killed while writing it
+			break
+		}
+
+		switch {
+		case line.Journal != "":
+			saved.journal = line.Journal
+		case line.Action != nil:
+			saved.records = append(saved.records, *line.Action)
+		case line.Done != nil:
+			saved.completed[*line.Done] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return savedPlan{}, err
+	}
+
+	if saved.journal == "" {
+		return savedPlan{}, fmt.Errorf("invalid checkpoint %s: journal not recorded", path)
+	}
+
+	return saved, nil
+}
+
+// Continues applying the plan of an interrupted run from the last completed
+// action. Files that were already moved or copied are checked first, copies
+// that are damaged are made again. ErrBlocked is returned when the rest of the
+// plan doesn't fit in the destination. Of the options only the destination, the
+// apply limits, the file system and the event sink are used.
+func Resume(ctx context.Context, options Options) (err error) {
+	events := newEmitter(options.Events)
+	defer func() {
+		if !errors.Is(err, ErrBlocked) {
+			events.failed(err)
+		}
+	}()
+
+	fsys := fileSystem(options.FS)
+	destinationPath := options.Destination
+	path := checkpointPath(destinationPath)
+	saved, err := readCheckpoint(fsys, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no interrupted run to resume in %s", destinationPath)
+		}
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	plan := Plan{destinationPath: destinationPath, options: options, fsys: fsys, events: events}
+	for _, r := range saved.records {
+		a, err := actionFromRecord(fsys, r, destinationPath)
+		if err != nil {
+			return fmt.Errorf("failed to restore plan: %w", err)
+		}
+		plan.actions = append(plan.actions, a)
+	}
+
+	plan.events.emit(Event{Type: EventResuming, Message: fmt.Sprintf("Resuming plan: %d of %d actions completed", len(saved.completed), len(plan.actions))})
+
+	var pending []int
+	for i, a := range plan.actions {
+		applied, err := isApplied(fsys, a)
+		if err != nil {
+			return err
+		}
+
+		if saved.completed[i] {
+			if applied || (a.aType != ActionCopy && a.aType != ActionMove && a.aType != ActionQuarantine) {
+				continue
+			}
+			if a.aType != ActionCopy {
+				return fmt.Errorf("can not resume: %s was moved but is missing or damaged at its destination", a.file.GetPath())
+			}
+
+			plan.events.emit(Event{Type: EventRedo, Message: fmt.Sprintf("Copy of %s is missing or damaged and will be made again", a.file.GetPath()), Action: &saved.records[i]})
+			pending = append(pending, i)
+			continue
+		}
+
+		// Actions that were running when the run stopped might have finished
+		// without being marked as completed
+		if !applied {
+			pending = append(pending, i)
+		}
+	}
+
+	plan.events.emit(Event{Type: EventApplying, Message: "Applying plan:"})
+	hasRoom, err := plan.checkFreeSpace(pending, options.ApplyLimits.SpaceMargin)
+	if err != nil {
+		return err
+	}
+	if !hasRoom {
+		return ErrBlocked
+	}
+
+	cp, err := openCheckpoint(fsys, path)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+
+	return plan.execute(ctx, pending, saved.records, options.ApplyLimits, &journal{fsys: fsys, path: saved.journal}, cp)
+}
+
+// Reports whether the effect of the action is already in place.
+func isApplied(fsys storage.FS, a action) (bool, error) {
+	switch a.aType {
+	case ActionMove, ActionCopy, ActionQuarantine:
+		target, err := a.target()
+		if err != nil {
+			return false, err
+		}
+		if checkFingerprint(fsys, target, a.file.GetFingerprint()) != nil {
+			return false, nil
+		}
+		if a.aType == ActionCopy {
+			return true, nil
+		}
+		_, err = fsys.Stat(a.file.GetPath())
+		return errors.Is(err, os.ErrNotExist), nil
+	case ActionDelete:
+		_, err := fsys.Stat(a.file.GetPath())
+		return errors.Is(err, os.ErrNotExist), nil
+	case ActionLink:
+		fileInfo, err := fsys.Stat(a.file.GetPath())
+		if err != nil {
+			return false, nil
+		}
+		keeperInfo, err := fsys.Stat(a.others[0].GetPath())
+		if err != nil {
+			return false, nil
+		}
+		return fsys.SameFile(fileInfo, keeperInfo), nil
+	default:
+		return false, nil
+	}
+}
+
+func makeRange(from, to int) []int {
+	var r []int
+	for i := from; i < to; i++ {
+		r = append(r, i)
+	}
+	return r
+}
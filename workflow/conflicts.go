@@ -0,0 +1,149 @@
+package workflow
+
+import (
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+const (
+	// Directory in the destination root used for files shutter-pilot manages itself.
+	// It is never scanned as part of the media library.
+	stateDirName      = ".shutter-pilot"
+	quarantineDirName = "quarantine"
+)
+
+type (
+	ConflictStrategy  string
+	DuplicateDisposal string
+)
+
+const (
+	// Reports conflicts and refuses to apply the plan until they are resolved by hand.
+	ConflictManual ConflictStrategy = "manual"
+	// Keeps the copy already located at its destination path.
+	ConflictKeepPlaced ConflictStrategy = "keep-placed"
+	// Keeps the copy with the oldest modification time.
+	ConflictKeepOldest ConflictStrategy = "keep-oldest"
+	// Keeps one copy and replaces the others with hard links to it.
+	ConflictHardlink ConflictStrategy = "hardlink"
+
+	// Leaves duplicates in place. Only applies to duplicates found in sources.
+	DisposeKeep       DuplicateDisposal = "keep"
+	DisposeQuarantine DuplicateDisposal = "quarantine"
+	DisposeDelete     DuplicateDisposal = "delete"
+)
+
+type ConflictPolicy struct {
+	Strategy ConflictStrategy
+	// What happens to copies that are not kept. Ignored by the hardlink strategy.
+	Disposal DuplicateDisposal
+}
+
+// Picks the copy that stays in the library. Files are expected to be ordered
+// by path so the choice does not depend on scan order.
+func chooseKeeper(fsys storage.FS, files []media.File, destinationPath string, strategy ConflictStrategy) (media.File, error) {
+	placed, err := firstPlacedFile(files, destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	return pickKeeper(fsys, files, placed, strategy)
+}
+
+// Picks the copy that stays, placed being the copy located at its destination
+// path or nil when none is.
+func pickKeeper(fsys storage.FS, files []media.File, placed media.File, strategy ConflictStrategy) (media.File, error) {
+	switch strategy {
+	case ConflictKeepPlaced, ConflictHardlink:
+		if placed != nil {
+			return placed, nil
+		}
+		return files[0], nil
+	case ConflictKeepOldest:
+		var oldest media.File
+		var oldestInfo fs.FileInfo
+		for _, f := range files {
+			info, err := fsys.Stat(f.GetPath())
+			if err != nil {
+				return nil, err
+			}
+			if oldest == nil || info.ModTime().Before(oldestInfo.ModTime()) ||
+				(info.ModTime().Equal(oldestInfo.ModTime()) && f == placed) {
+				oldest = f
+				oldestInfo = info
+			}
+		}
+		return oldest, nil
+	default:
+		return nil, fmt.Errorf("unsupported conflict strategy: %s", strategy)
+	}
+}
+
+func firstPlacedFile(files []media.File, destinationPath string) (media.File, error) {
+	for _, f := range files {
+		dstPath, err := f.GetDestinationPath(destinationPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s %w", f.GetPath(), err)
+		}
+		if f.GetPath() == dstPath {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the files with hard links to the same file counted once, keeping the
+// link that is located at its destination path when there is one. Files are
+// expected to be ordered by path.
+func withoutHardLinks(fsys storage.FS, files []media.File, destinationPath string) ([]media.File, error) {
+	if len(files) < 2 {
+		return files, nil
+	}
+
+	groups, err := linkGroups(fsys, files)
+	if err != nil {
+		return nil, err
+	}
+
+	distinct := make([]media.File, 0, len(groups))
+	for _, links := range groups {
+		if len(links) == 1 {
+			distinct = append(distinct, links[0])
+			continue
+		}
+
+		placed, err := firstPlacedFile(links, destinationPath)
+		if err != nil {
+			return nil, err
+		}
+		if placed == nil {
+			placed = links[0]
+		}
+		distinct = append(distinct, placed)
+	}
+	return distinct, nil
+}
+
+// Groups the files that are hard links to the same file, keeping their order.
+func linkGroups(fsys storage.FS, files []media.File) ([][]media.File, error) {
+	var groups [][]media.File
+	var infos []fs.FileInfo
+	for _, f := range files {
+		info, err := fsys.Stat(f.GetPath())
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(infos, func(other fs.FileInfo) bool { return fsys.SameFile(other, info) })
+		if i == -1 {
+			groups = append(groups, []media.File{f})
+			infos = append(infos, info)
+			continue
+		}
+		groups[i] = append(groups[i], f)
+	}
+	return groups, nil
+}
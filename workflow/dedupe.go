@@ -0,0 +1,392 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+type (
+	DedupeAction string
+	KeeperRule   string
+)
+
+const (
+	// Only lists the duplicate sets.
+	DedupeList DedupeAction = "list"
+	// Replaces the copies that are not kept with hard links to the kept one.
+	DedupeLink DedupeAction = "link"
+	// Moves the copies that are not kept to the quarantine directory of their library.
+	DedupeQuarantine DedupeAction = "quarantine"
+	// Deletes the copies that are not kept.
+	DedupeDelete DedupeAction = "delete"
+
+	// Keeps the copy located at its destination path in its library, the first
+	// one by path when none is.
+	KeepPlaced KeeperRule = "placed"
+	// Keeps the copy with the oldest modification time.
+	KeepOldest KeeperRule = "oldest"
+	// Keeps a copy in the library listed first, picked among the copies in it
+	// like placed does.
+	KeepFirstRoot KeeperRule = "first-root"
+)
+
+type DedupeOptions struct {
+	// Libraries to look for duplicates in, copies are found across them. The
+	// journal of the run is kept in the first one.
+	Roots  []string
+	Action DedupeAction
+	Keep   KeeperRule
+	// File types to look at, all of them when empty
+	Filter []string
+	// Glob patterns of files and directories to leave out of scans, like the
+	// ones of Options
+	Exclude []string
+	Include []string
+	// Scans the directories symbolic links point to
+	FollowSymlinks bool
+	// Layout the libraries are organised with, which tells the copies that are
+	// at their destination path
+	NoSooc      bool
+	DayStartsAt time.Duration
+	ScanLimits  ScanLimits
+	ApplyLimits ApplyLimits
+	// Allows the plan to delete files
+	AllowDelete bool
+	// Receives the progress and results of the run, can be nil
+	Events EventSink
+	// File system of the libraries, the one of the OS when nil
+	FS storage.FS
+}
+
+// Finds copies of the same media in libraries and works out the actions that
+// remove them.
+type Deduper struct {
+	options DedupeOptions
+}
+
+func NewDeduper(options DedupeOptions) *Deduper {
+	return &Deduper{options: options}
+}
+
+// Files with the same contents. Hard links to the same file count as one copy.
+type DuplicateSet struct {
+	Fingerprint string `json:"fingerprint"`
+	// Size of a single copy
+	Size int64  `json:"size"`
+	Kept string `json:"kept"`
+	// Paths of the copies that are not kept, with the hard links to them
+	Copies []string `json:"copies"`
+	// Bytes freed once only the kept copy is left
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// Totals of the duplicate sets found by a dedupe run.
+type DedupeSummary struct {
+	Sets int `json:"sets"`
+	// Copies that are not kept, hard links to the same file counted once
+	Copies      int   `json:"copies"`
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// Duplicate sets found by a deduper together with the plan that removes the
+// copies that are not kept. The plan has no actions when the sets are only
+// listed.
+type DedupePlan struct {
+	*Plan
+	sets    []DuplicateSet
+	summary DedupeSummary
+	// Libraries in the order they were given, and the one each file is in
+	roots  []string
+	rootOf map[media.File]string
+}
+
+func (p *DedupePlan) Sets() []DuplicateSet {
+	return p.sets
+}
+
+func (p *DedupePlan) DedupeSummary() DedupeSummary {
+	return p.summary
+}
+
+// Scans the libraries, groups the files with the same contents and works out
+// the actions for the copies that are not kept.
+func (d *Deduper) Plan(ctx context.Context) (_ *DedupePlan, err error) {
+	opts := d.options
+	fsys := fileSystem(opts.FS)
+	events := newEmitter(opts.Events)
+	defer func() { events.failed(err) }()
+	events.emit(Event{Type: EventPlanning, Message: "looking for duplicates... (depending on disk used and number of files this might take a while)"})
+
+	if len(opts.Roots) == 0 {
+		return nil, errors.New("no library to look for duplicates in")
+	}
+
+	filter := opts.Filter
+	if len(filter) == 0 {
+		filter = []string{string(media.JpgMedia), string(media.RafMedia), string(media.MovMedia), string(media.Mp4Media)}
+	}
+	scan := scanOptions{
+		filter:         filter,
+		ignore:         ignoreRules{exclude: opts.Exclude, include: opts.Include},
+		followSymlinks: opts.FollowSymlinks,
+		noSooc:         opts.NoSooc,
+		dayStartsAt:    opts.DayStartsAt,
+		limits:         opts.ScanLimits,
+		// Shared by all roots, the cap is on the total bandwidth
+		bandwidth: newBandwidthLimiter(opts.ScanLimits.BytesPerSecond),
+	}
+
+	rootOf := make(map[media.File]string)
+	byFingerprint := make(map[string][]media.File)
+	for _, root := range opts.Roots {
+		files, _, err := scanFiles(ctx, fsys, root, scan, events)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil, errors.New("Plan creation interrupted")
+			}
+			return nil, fmt.Errorf("error occurred while scanning library '%s': %w", root, err)
+		}
+
+		for _, f := range files {
+			rootOf[f] = root
+			byFingerprint[f.GetFingerprint()] = append(byFingerprint[f.GetFingerprint()], f)
+		}
+	}
+
+	plan := &DedupePlan{
+		Plan: &Plan{
+			destinationPath: opts.Roots[0],
+			options:         Options{ApplyLimits: opts.ApplyLimits, AllowDelete: opts.AllowDelete},
+			fsys:            fsys,
+			events:          events,
+		},
+		roots:  opts.Roots,
+		rootOf: rootOf,
+	}
+
+	// Sets are listed in the same order on every run
+	fingerprints := make([]string, 0, len(byFingerprint))
+	for fingerprint, files := range byFingerprint {
+		if len(files) > 1 {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	slices.Sort(fingerprints)
+
+	for _, fingerprint := range fingerprints {
+		files := byFingerprint[fingerprint]
+		slices.SortFunc(files, func(a, b media.File) int {
+			return strings.Compare(a.GetPath(), b.GetPath())
+		})
+
+		err := plan.addSet(files, opts.Keep, opts.Action)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = plan.report()
+	if err != nil {
+		return nil, fmt.Errorf("error occured while reporting plan: %w", err)
+	}
+
+	return plan, nil
+}
+
+// Adds the set of the files with the same contents, and the actions for the
+// copies that are not kept, when they are more than one copy. Fingerprints only
+// cover the start and end of a file, so before a copy is linked, quarantined or
+// deleted its whole contents are compared with the kept copy, and copies that
+// differ are left out of the set.
+func (p *DedupePlan) addSet(files []media.File, rule KeeperRule, disposal DedupeAction) error {
+	groups, err := linkGroups(p.fsys, files)
+	if err != nil {
+		return err
+	}
+	if len(groups) < 2 {
+		return nil
+	}
+
+	// One copy stands for each group of links when the keeper is picked
+	copies := make([]media.File, 0, len(groups))
+	for _, links := range groups {
+		placed := p.placedFile(links)
+		if placed == nil {
+			placed = links[0]
+		}
+		copies = append(copies, placed)
+	}
+	keeper, err := p.chooseCopy(copies, rule)
+	if err != nil {
+		return err
+	}
+
+	info, err := p.fsys.Stat(keeper.GetPath())
+	if err != nil {
+		return err
+	}
+	set := DuplicateSet{Fingerprint: keeper.GetFingerprint(), Size: info.Size(), Kept: keeper.GetPath()}
+
+	keeperDevice := p.fsys.DeviceID(keeper.GetPath(), info)
+	removed := 0
+	for i, links := range groups {
+		if copies[i] == keeper {
+			continue
+		}
+
+		if disposal == DedupeLink {
+			linkInfo, err := p.fsys.Stat(links[0].GetPath())
+			if err != nil {
+				return err
+			}
+			if p.fsys.DeviceID(links[0].GetPath(), linkInfo) != keeperDevice {
+				p.events.emit(Event{
+					Type:    EventWarning,
+					Message: fmt.Sprintf("Warning: %s is left as it is, it is on another disk than %s and can't be linked to it", links[0].GetPath(), keeper.GetPath()),
+					Path:    links[0].GetPath(),
+				})
+				continue
+			}
+		}
+
+		if disposal != DedupeList {
+			same, err := sameContents(p.fsys, links[0].GetPath(), keeper.GetPath())
+			if err != nil {
+				return fmt.Errorf("failed to compare %s with %s: %w", links[0].GetPath(), keeper.GetPath(), err)
+			}
+			if !same {
+				p.events.emit(Event{
+					Type:    EventWarning,
+					Message: fmt.Sprintf("Warning: %s is left as it is, its fingerprint matches %s but its contents differ", links[0].GetPath(), keeper.GetPath()),
+					Path:    links[0].GetPath(),
+				})
+				continue
+			}
+		}
+
+		removed++
+		set.Reclaimable += set.Size
+		for _, f := range links {
+			set.Copies = append(set.Copies, f.GetPath())
+
+			switch disposal {
+			case DedupeLink:
+				p.addAction(newLinkAction(p.fsys, f, keeper))
+			case DedupeQuarantine:
+				p.addAction(newQuarantineAction(p.fsys, f, keeper, p.rootOf[f]))
+			case DedupeDelete:
+				p.addAction(newDeleteAction(p.fsys, f, fmt.Sprintf("duplicate of %s", keeper.GetPath())))
+			}
+		}
+	}
+
+	if len(set.Copies) > 0 {
+		p.sets = append(p.sets, set)
+		p.summary.Sets++
+		p.summary.Copies += removed
+		p.summary.Reclaimable += set.Reclaimable
+	}
+	return nil
+}
+
+// Reports whether the two files hold the same bytes, reading both of them to
+// the end.
+func sameContents(fsys storage.FS, a, b string) (bool, error) {
+	fileA, err := fsys.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+	fileB, err := fsys.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	bufA := make([]byte, 1024*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return false, errA
+		}
+		if errB != nil && !endB {
+			return false, errB
+		}
+		if endA || endB {
+			return endA && endB, nil
+		}
+	}
+}
+
+// Picks the copy that stays. Copies are expected to be ordered by path.
+func (p *DedupePlan) chooseCopy(copies []media.File, rule KeeperRule) (media.File, error) {
+	switch rule {
+	case "", KeepPlaced:
+		return pickKeeper(p.fsys, copies, p.placedFile(copies), ConflictKeepPlaced)
+	case KeepOldest:
+		return pickKeeper(p.fsys, copies, p.placedFile(copies), ConflictKeepOldest)
+	case KeepFirstRoot:
+		for _, root := range p.roots {
+			inRoot := slices.DeleteFunc(slices.Clone(copies), func(f media.File) bool {
+				return p.rootOf[f] != root
+			})
+			if len(inRoot) > 0 {
+				return pickKeeper(p.fsys, inRoot, p.placedFile(inRoot), ConflictKeepPlaced)
+			}
+		}
+		return copies[0], nil
+	default:
+		return nil, fmt.Errorf("unsupported keeper rule: %s", rule)
+	}
+}
+
+// Returns the first of the files located at its destination path in its
+// library, nil when none is. Files without a capture time are never placed,
+// they don't stop the rest of the library from being deduplicated.
+func (p *DedupePlan) placedFile(files []media.File) media.File {
+	for _, f := range files {
+		dstPath, err := f.GetDestinationPath(p.rootOf[f])
+		if err == nil && f.GetPath() == dstPath {
+			return f
+		}
+	}
+	return nil
+}
+
+// Lists the duplicate sets and their totals, followed by the actions when
+// there are any.
+func (p *DedupePlan) report() error {
+	for i := range p.sets {
+		set := &p.sets[i]
+		p.events.emit(Event{
+			Type:       EventDuplicateSet,
+			Message:    fmt.Sprintf("%s has %d copies", set.Kept, len(set.Copies)),
+			Path:       set.Kept,
+			Duplicates: set,
+		})
+	}
+	summary := p.summary
+	p.events.emit(Event{Type: EventDedupeSummary, Message: "Dedupe Summary", DedupeSummary: &summary})
+
+	if len(p.actions) == 0 {
+		return nil
+	}
+	return p.Plan.report(p.events)
+}
@@ -0,0 +1,185 @@
+package workflow
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Kind of an event reported while planning, applying or undoing.
+type EventType string
+
+const (
+	// The plan is being built
+	EventPlanning EventType = "planning"
+	// A source or the destination is being scanned, Path is the directory
+	EventScanning EventType = "scanning"
+	// The destination paths of the scanned files are being worked out
+	EventLocating EventType = "locating"
+	// A file was fingerprinted and its capture time read, Path is the file
+	EventFileScanned EventType = "file-scanned"
+	// A source file was left out by the capture filter, Path is the file
+	EventFiltered EventType = "filtered"
+	// Progress of the running phase, reported a few times a second
+	EventProgress EventType = "progress"
+	// The phase is done, Progress holds its totals
+	EventPhaseDone EventType = "phase-done"
+	// An action was added to the plan, Action is the action
+	EventPlanned EventType = "planned"
+	// The plan is ready, Summary counts its actions
+	EventPlanSummary EventType = "plan-summary"
+	// The plan is being applied
+	EventApplying EventType = "applying"
+	// The plan of an interrupted run is being applied again
+	EventResuming EventType = "resuming"
+	// An action that was completed before the run was interrupted will run again
+	EventRedo EventType = "redo"
+	// An action was applied, Action is the action
+	EventAction EventType = "action"
+	// The plan can't be applied until the problem in Message is solved
+	EventBlocked EventType = "blocked"
+	// The plan is applied, but something in Message might need attention
+	EventWarning EventType = "warning"
+	// The changes of the run are recorded in the journal at Path
+	EventJournal EventType = "journal"
+	// The run stopped before every action was applied
+	EventIncomplete EventType = "incomplete"
+	// The run recorded in the journal at Path is being undone
+	EventUndoing EventType = "undoing"
+	// A change recorded in the journal was reversed
+	EventUndo EventType = "undo"
+	// A change recorded in the journal was left as it is, Err says why
+	EventUndoSkipped EventType = "undo-skipped"
+	// The run recorded in the journal is undone, UndoSummary counts the changes
+	EventUndone EventType = "undone"
+	// The files placed in the destination at Path are being verified
+	EventVerifying EventType = "verifying"
+	// A placed file still has the fingerprint it was placed with
+	EventVerified EventType = "verified"
+	// A placed file is missing or damaged, Err says which
+	EventVerifyFailed EventType = "verify-failed"
+	// The destination is verified, VerifySummary counts the files
+	EventVerifySummary EventType = "verify-summary"
+	// Files with the same contents were found by a dedupe run, Duplicates holds
+	// them
+	EventDuplicateSet EventType = "duplicate-set"
+	// The duplicates are found, DedupeSummary holds their totals
+	EventDedupeSummary EventType = "dedupe-summary"
+	// The library at Path is scanned, Stats holds its statistics
+	EventStats EventType = "stats"
+	// The mount directory at Path is watched for cards
+	EventWatching EventType = "watching"
+	// A volume without a DCIM directory was mounted at Path
+	EventCardIgnored EventType = "card-ignored"
+	// A card with its DCIM directory at Path was mounted and is imported
+	EventCardMounted EventType = "card-mounted"
+	// The card with its DCIM directory at Path is imported
+	EventCardImported EventType = "card-imported"
+	// The card with its DCIM directory at Path was left as it is, Err is
+	// ErrBlocked when its plan was blocked
+	EventCardSkipped EventType = "card-skipped"
+	// The import of the card with its DCIM directory at Path failed with Err,
+	// watching goes on
+	EventCardFailed EventType = "card-failed"
+	// The run failed with Err
+	EventError EventType = "error"
+)
+
+// Returns how much events of the type matter. Per file details are debug
+// events, problems that need attention are warnings.
+func levelOf(t EventType) slog.Level {
+	switch t {
+	case EventFileScanned, EventFiltered, EventCardIgnored, EventVerified:
+		return slog.LevelDebug
+	case EventRedo, EventBlocked, EventWarning, EventIncomplete, EventUndoSkipped, EventVerifyFailed:
+		return slog.LevelWarn
+	case EventError, EventCardFailed:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Something that happened while planning, applying or undoing. Only the fields
+// that apply to the type of the event are set.
+type Event struct {
+	Type  EventType
+	Level slog.Level
+	// Describes the event in a sentence, e.g. the line printed for it
+	Message string
+	Path    string
+	// Action the event is about
+	Action *Action
+	// Progress of the running phase
+	Progress    *Progress
+	Summary     *Summary
+	UndoSummary *UndoSummary
+	// Files checked by a verify run
+	VerifySummary *VerifySummary
+	// Files with the same contents
+	Duplicates    *DuplicateSet
+	DedupeSummary *DedupeSummary
+	Stats         *LibraryStats
+	Err           error
+	Time          time.Time
+}
+
+// Receives the events of a run. Events are delivered one at a time, in the order
+// they happen.
+type EventSink interface {
+	Handle(Event)
+}
+
+// Function that receives the events of a run, so a function can be used as a
+// sink.
+type EventHandler func(Event)
+
+func (h EventHandler) Handle(e Event) {
+	h(e)
+}
+
+// Progress of a phase, such as fingerprinting files or applying actions.
+type Progress struct {
+	Phase string `json:"phase"`
+	// What is counted, e.g. files
+	Unit       string `json:"unit"`
+	Done       int64  `json:"done"`
+	Total      int64  `json:"total"`
+	DoneBytes  int64  `json:"doneBytes"`
+	TotalBytes int64  `json:"totalBytes"`
+	// Set once everything to do is counted, until then the totals grow
+	Counted bool          `json:"counted"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Passes events to the sink one at a time. Without a sink the events are
+// dropped.
+type emitter struct {
+	mu   sync.Mutex
+	sink EventSink
+}
+
+func newEmitter(sink EventSink) *emitter {
+	return &emitter{sink: sink}
+}
+
+func (e *emitter) emit(event Event) {
+	if e == nil || e.sink == nil {
+		return
+	}
+	event.Level = levelOf(event.Type)
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sink.Handle(event)
+}
+
+// Reports the error a run failed with, if it failed.
+func (e *emitter) failed(err error) {
+	if err != nil {
+		e.emit(Event{Type: EventError, Message: err.Error(), Err: err})
+	}
+}
@@ -0,0 +1,110 @@
+package workflow
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Name of the file in a source or destination directory with patterns of the
+// files and directories its scans leave out, one per line.
+const ignoreFileName = ".shutterpilotignore"
+
+// Left out of every scan: hidden files and directories, which covers the
+// resource forks macOS writes to cards and its trash and index directories, and
+// the system, trash and thumbnail directories of Windows, NAS and Lightroom.
+var defaultExcludes = []string{
+	".*",
+	"$RECYCLE.BIN",
+	"System Volume Information",
+	"@eaDir",
+	"#recycle",
+	"#snapshot",
+	"*.lrdata",
+}
+
+// Patterns that pick the files and directories a scan reads.
+type ignoreRules struct {
+	// Left out together with everything under them
+	exclude []string
+	// When set, only files that match one of them are read
+	include []string
+}
+
+// Reports whether the glob pattern is well formed.
+func ValidatePattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// Returns the rules of a scan of root, which add the default excludes and the
+// patterns of the ignore file in root to the rules of the run. Blank lines and
+// lines starting with # are skipped in the ignore file.
+func (r ignoreRules) forRoot(fsys storage.FS, root string) (ignoreRules, error) {
+	rules := ignoreRules{
+		exclude: slices.Concat(defaultExcludes, r.exclude),
+		include: r.include,
+	}
+
+	ignoreFile := filepath.Join(root, ignoreFileName)
+	file, err := fsys.Open(ignoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return ignoreRules{}, fmt.Errorf("failed to read %s: %w", ignoreFile, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		err := ValidatePattern(pattern)
+		if err != nil {
+			return ignoreRules{}, fmt.Errorf("invalid pattern on line %d of %s: %s", line, ignoreFile, pattern)
+		}
+		rules.exclude = append(rules.exclude, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return ignoreRules{}, fmt.Errorf("failed to read %s: %w", ignoreFile, err)
+	}
+
+	return rules, nil
+}
+
+// Reports whether the file or directory at rel, the slash separated path
+// relative to the scanned directory, is left out.
+func (r ignoreRules) excluded(rel string, isDir bool) bool {
+	if matchAny(r.exclude, rel) {
+		return true
+	}
+	return !isDir && len(r.include) > 0 && !matchAny(r.include, rel)
+}
+
+// Patterns with a slash are matched against the whole path, others against the
+// name.
+func matchAny(patterns []string, rel string) bool {
+	name := path.Base(rel)
+	for _, pattern := range patterns {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = rel
+			pattern = strings.TrimPrefix(pattern, "/")
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package workflow
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+const journalDirName = "journal"
+
+type journalEntry struct {
+	Action      ActionType `json:"action"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Fingerprint string     `json:"fingerprint"`
+	Time        time.Time  `json:"time"`
+}
+
+// Append-only record of the files an apply run moved or copied. The file is
+// only created once the first entry is recorded.
+type journal struct {
+	fsys storage.FS
+	path string
+	file storage.File
+}
+
+// Runs that start within the same second, like imports of cards one after the
+// other while watching, get a number after the time so each can be undone on
+// its own.
+func newJournal(fsys storage.FS, destinationPath string) *journal {
+	dir := filepath.Join(destinationPath, stateDirName, journalDirName)
+	stamp := time.Now().Format("2006-01-02T15-04-05")
+
+	path := filepath.Join(dir, stamp+".jsonl")
+	for n := 2; ; n++ {
+		// Other errors come up again once the journal is written
+		if _, err := fsys.Stat(path); err != nil {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.jsonl", stamp, n))
+	}
+	return &journal{fsys: fsys, path: path}
+}
+
+func (j *journal) record(a action) error {
+	if a.target == nil {
+		return nil
+	}
+
+	dstPath, err := a.target()
+	if err != nil {
+		return err
+	}
+
+	source, err := storage.Abs(a.file.GetPath())
+	if err != nil {
+		return err
+	}
+	destination, err := storage.Abs(dstPath)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(journalEntry{
+		Action:      a.aType,
+		Source:      source,
+		Destination: destination,
+		Fingerprint: a.file.GetFingerprint(),
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if j.file == nil {
+		err := j.fsys.MkdirAll(filepath.Dir(j.path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		j.file, err = j.fsys.Append(j.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+func readJournal(fsys storage.FS, journalPath string) ([]journalEntry, error) {
+	f, err := fsys.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var e journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid journal entry on line %d: %w", lineNumber, err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Number of changes reversed by an undo run.
+type UndoSummary struct {
+	Restored int `json:"restored"`
+	Removed  int `json:"removed"`
+	Skipped  int `json:"skipped"`
+}
+
+// Reverses an apply run recorded in the journal, newest entry first. Moved files
+// are moved back and copies are removed, but only while the file at the
+// destination still has the recorded fingerprint. Of the options only the file
+// system and the event sink are used.
+func Undo(ctx context.Context, journalPath string, options Options) (_ UndoSummary, err error) {
+	events := newEmitter(options.Events)
+	defer func() { events.failed(err) }()
+
+	fsys := fileSystem(options.FS)
+	entries, err := readJournal(fsys, journalPath)
+	if err != nil {
+		return UndoSummary{}, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	events.emit(Event{Type: EventUndoing, Message: fmt.Sprintf("Undoing %s:", journalPath), Path: journalPath})
+	var summary UndoSummary
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		select {
+		case <-ctx.Done():
+			return summary, ctx.Err()
+		default:
+		}
+
+		e := entries[i]
+		var (
+			result string
+			err    error
+		)
+		switch e.Action {
+		case ActionMove, ActionQuarantine:
+			result, err = undoMove(fsys, e)
+			if err == nil {
+				summary.Restored++
+			}
+		case ActionCopy:
+			result, err = undoCopy(fsys, e)
+			if err == nil {
+				summary.Removed++
+			}
+		default:
+			err = fmt.Errorf("unsupported action: %s", e.Action)
+		}
+
+		if err != nil {
+			events.emit(Event{Type: EventUndoSkipped, Message: fmt.Sprintf("Skipping %s: %s", e.Destination, err), Path: e.Destination, Err: err})
+			summary.Skipped++
+			continue
+		}
+		events.emit(Event{Type: EventUndo, Message: result, Path: e.Destination})
+	}
+
+	events.emit(Event{Type: EventUndone, Message: "Undo Summary", UndoSummary: &summary})
+	return summary, nil
+}
+
+func undoMove(fsys storage.FS, e journalEntry) (string, error) {
+	err := checkFingerprint(fsys, e.Destination, e.Fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := fsys.Stat(e.Source); err == nil {
+		return "", fmt.Errorf("%s already exists", e.Source)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	err = fsys.MkdirAll(filepath.Dir(e.Source), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	err = moveFile(fsys, e.Destination, e.Source, e.Fingerprint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Moving back from %s to %s", e.Destination, e.Source), nil
+}
+
+func undoCopy(fsys storage.FS, e journalEntry) (string, error) {
+	err := checkFingerprint(fsys, e.Destination, e.Fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	err = fsys.Remove(e.Destination)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Removing copy %s", e.Destination), nil
+}
+
+func checkFingerprint(fsys storage.FS, path, fingerprint string) error {
+	hash, err := partialHash(fsys, path)
+	if err != nil {
+		return err
+	}
+	if hash != fingerprint {
+		return errors.New("contents changed since it was recorded")
+	}
+	return nil
+}
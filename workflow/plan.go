@@ -4,7 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 )
 
 const (
@@ -13,20 +21,127 @@ const (
 	oneGB = 1024 * oneMB
 )
 
+// Returned by Apply when the plan was not applied because of a problem that
+// needs attention first, a blocked event tells which.
+var ErrBlocked = errors.New("plan is blocked")
+
+// Options of a run. Apart from the sources and the destination, the zero value
+// of an option is its default.
+type Options struct {
+	Sources     []string
+	Destination string
+	// Moves files from the sources instead of copying them
+	MoveMode bool
+	// File types to organise, all of them when empty
+	Filter []string
+	// Places jpg photos next to the raw files instead of under a sooc directory
+	NoSooc bool
+	// Time of day when a new day begins
+	DayStartsAt time.Duration
+	// Source files captured before it are left out, when set
+	Since time.Time
+	// Source files captured at or after it are left out, when set
+	Until time.Time
+	// Only source files captured with one of the cameras are organised, all of
+	// them when empty. A camera matches any part of the model, without regard
+	// to case. Videos don't record the camera in a way that is read, so they
+	// are left out when filtering by camera.
+	Cameras []string
+	// Glob patterns of files and directories to leave out of the source scans,
+	// on top of the default ones and the ones in the .shutterpilotignore file
+	// of each source. Patterns with a slash are matched against the path
+	// relative to the source, others against the name. The destination is only
+	// scanned with the default patterns and its own .shutterpilotignore.
+	Exclude []string
+	// Glob patterns of the source files to scan, all files that aren't excluded
+	// when empty
+	Include []string
+	// Scans the directories symbolic links point to. Links to files are always
+	// read through.
+	FollowSymlinks bool
+	// Counts hard links to the same file in the destination once, instead of as
+	// duplicates that conflict
+	DedupeHardLinks  bool
+	ConflictPolicy   ConflictPolicy
+	SourceDuplicates DuplicateDisposal
+	ScanLimits       ScanLimits
+	ApplyLimits      ApplyLimits
+	// Allows the plan to delete files
+	AllowDelete bool
+	// Receives the progress and results of the run, can be nil
+	Events EventSink
+	// File system of the sources and the destination, the one of the OS when nil
+	FS storage.FS
+}
+
+func fileSystem(fsys storage.FS) storage.FS {
+	if fsys == nil {
+		return storage.OS{}
+	}
+	return fsys
+}
+
+// Builds plans that organise the media of the sources into the destination.
+type Planner struct {
+	options Options
+}
+
+func NewPlanner(options Options) *Planner {
+	return &Planner{options: options}
+}
+
+// Actions that organise the media, worked out by a planner. Nothing is changed
+// until the plan is applied.
 type Plan struct {
-	actions []action
+	actions         []action
+	destinationPath string
+	options         Options
+	fsys            storage.FS
+	events          *emitter
+	// Number of source files left out by the capture filter
+	filtered int
 }
 
 func (p *Plan) addAction(action action) {
 	p.actions = append(p.actions, action)
 }
 
-func (p *Plan) handleDestinationsConflicts(mediaMaps *MediaMaps) {
-	for _, files := range mediaMaps.DestMap {
-		if len(files) > 1 {
+func (p *Plan) handleDestinationsConflicts(mediaMaps *MediaMaps, destinationPath string) error {
+	for hash, files := range mediaMaps.DestMap {
+		if len(files) < 2 {
+			continue
+		}
+
+		if p.options.ConflictPolicy.Strategy == "" || p.options.ConflictPolicy.Strategy == ConflictManual {
 			p.addAction(newConflictAction(files))
+			continue
+		}
+
+		keeper, err := chooseKeeper(p.fsys, files, destinationPath, p.options.ConflictPolicy.Strategy)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f == keeper {
+				continue
+			}
+
+			switch {
+			case p.options.ConflictPolicy.Strategy == ConflictHardlink:
+				p.addAction(newLinkAction(p.fsys, f, keeper))
+			case p.options.ConflictPolicy.Disposal == DisposeDelete:
+				p.addAction(newDeleteAction(p.fsys, f, fmt.Sprintf("duplicate of %s", keeper.GetPath())))
+			default:
+				p.addAction(newQuarantineAction(p.fsys, f, keeper, destinationPath))
+			}
 		}
+
+		// Only the kept copy takes part in the rest of the plan
+		mediaMaps.DestMap[hash] = []media.File{keeper}
 	}
+
+	return nil
 }
 
 func (p *Plan) handleDestinationFiles(mediaMaps *MediaMaps, destinationPath string) error {
@@ -37,7 +152,7 @@ func (p *Plan) handleDestinationFiles(mediaMaps *MediaMaps, destinationPath stri
 		}
 
 		if e[0].GetPath() != mediaDestPath {
-			p.addAction(newMoveAction(e[0], destinationPath))
+			p.addAction(newMoveAction(p.fsys, e[0], destinationPath))
 		}
 	}
 
@@ -50,125 +165,351 @@ func (p *Plan) handleSourceFiles(mediaMaps *MediaMaps, moveMode bool, destinatio
 			p.addAction(newSkipAction(srcMedia, e[0]))
 		} else {
 			if moveMode {
-				p.addAction(newMoveAction(srcMedia, destinationPath))
+				p.addAction(newMoveAction(p.fsys, srcMedia, destinationPath))
 			} else {
-				p.addAction(newCopyAction(srcMedia, destinationPath))
+				p.addAction(newCopyAction(p.fsys, srcMedia, destinationPath))
 			}
 		}
 	}
 }
 
-func (p *Plan) Apply(ctx context.Context) error {
-	fmt.Println("Applying plan:")
-	var builder strings.Builder
-	excutedActionCount := 0
+// Reports source files that have the same contents as another source file. In
+// move mode they can be removed from the source as well, once the kept copy
+// has been imported.
+func (p *Plan) handleSourceDuplicates(mediaMaps *MediaMaps, moveMode bool, disposal DuplicateDisposal, destinationPath string) {
+	if !moveMode || disposal == "" || disposal == DisposeKeep {
+		for _, d := range mediaMaps.SourceDuplicates {
+			p.addAction(newDuplicateAction(d.File, d.Kept))
+		}
+		return
+	}
+
+	// Added after all imports so the kept copies are in place when these run
+	for _, d := range mediaMaps.SourceDuplicates {
+		imported := d.Kept
+		if e, exists := mediaMaps.DestMap[d.Kept.GetFingerprint()]; exists {
+			imported = e[0]
+		}
+
+		if disposal == DisposeDelete {
+			p.addAction(afterImport(p.fsys, newDeleteAction(p.fsys, d.File, fmt.Sprintf("duplicate of %s", d.Kept.GetPath())), imported, destinationPath))
+		} else {
+			p.addAction(afterImport(p.fsys, newQuarantineAction(p.fsys, d.File, d.Kept, d.Root), imported, destinationPath))
+		}
+	}
+}
+
+// Applies the actions of the plan. Nothing is changed when the plan has
+// conflicts, deletes files without that being allowed or does not fit in the
+// destination, a blocked event tells which and ErrBlocked is returned.
+func (p *Plan) Apply(ctx context.Context) (err error) {
+	defer func() {
+		if !errors.Is(err, ErrBlocked) {
+			p.events.failed(err)
+		}
+	}()
+	p.events.emit(Event{Type: EventApplying, Message: "Applying plan:"})
 
 	for _, a := range p.actions {
-		if a.aType == conflict {
-			fmt.Println("  File conflicts need to be resolved before application can proceed. Resolve them and rerun application to continue.")
-			return nil
+		if a.aType == ActionConflict {
+			p.events.emit(Event{Type: EventBlocked, Message: "File conflicts need to be resolved before application can proceed. Resolve them and rerun application to continue."})
+			return ErrBlocked
 		}
 	}
 
-	for _, action := range p.actions {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			result, err := action.execute()
-			excutedActionCount++
-			if err != nil {
-				return err
+	if !p.options.AllowDelete {
+		for _, a := range p.actions {
+			if a.aType == ActionDelete && !a.confirmed {
+				p.events.emit(Event{Type: EventBlocked, Message: "Plan deletes files. Review the plan and rerun application with --confirm-delete to continue."})
+				return ErrBlocked
 			}
-			builder.WriteString(fmt.Sprintf("  %s\n", result))
+		}
+	}
+
+	hasRoom, err := p.checkFreeSpace(makeRange(0, len(p.actions)), p.options.ApplyLimits.SpaceMargin)
+	if err != nil {
+		return err
+	}
+	if !hasRoom {
+		return ErrBlocked
+	}
+
+	j := newJournal(p.fsys, p.destinationPath)
+	records, err := p.Actions()
+	if err != nil {
+		return err
+	}
+
+	cp, err := createCheckpoint(p.fsys, p.destinationPath, j.path, records)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	return p.execute(ctx, makeRange(0, len(p.actions)), records, p.options.ApplyLimits, j, cp)
+}
+
+// Executes the actions at the given indexes, recording each completed one in
+// the journal and the checkpoint. Independent actions run in parallel within
+// the limits, actions touching the same files keep the order of the plan.
+func (p *Plan) execute(ctx context.Context, indexes []int, records []Action, limits ApplyLimits, j *journal, cp *checkpoint) error {
+	defer func() {
+		j.close()
+		if j.file != nil {
+			p.events.emit(Event{Type: EventJournal, Message: fmt.Sprintf("Changes recorded in %s", j.path), Path: j.path})
+		}
+	}()
+
+	completed := false
+	defer func() {
+		if !completed {
+			cp.close()
+			p.events.emit(Event{Type: EventIncomplete, Message: "Plan was not applied completely. Run the resume command with the destination directory to continue where it stopped."})
+		}
+	}()
+
+	s, err := p.newSchedule(indexes)
+	if err != nil {
+		return fmt.Errorf("failed to schedule actions: %w", err)
+	}
+	limiter := newDeviceLimiter(limits.PerDevice)
+
+	progress := newProgress(p.events, "applying", "actions")
+	defer progress.finish()
+	for _, i := range indexes {
+		progress.add(1, s.bytes[i])
+	}
+	progress.done()
+
+	finished := make(map[int]chan struct{}, len(indexes))
+	for _, i := range indexes {
+		finished[i] = make(chan struct{})
+	}
+
+	var (
+		mu     sync.Mutex
+		failed atomic.Bool
+	)
 
-			if excutedActionCount > 100 {
-				fmt.Print(builder.String())
-				builder.Reset()
+	wp := newWorkerPool[int](len(indexes), max(limits.Workers, 1), progress)
+	for _, i := range indexes {
+		wp.enqueue(i)
+	}
+
+	wp.start(ctx, func(i int) error {
+		defer close(finished[i])
+
+		for _, d := range s.dependencies[i] {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-finished[d]:
 			}
 		}
+		// Nothing new is started once an action failed
+		if failed.Load() {
+			return nil
+		}
+
+		release, err := limiter.acquire(ctx, s.devices[i])
+		if err != nil {
+			return err
+		}
+		action := p.actions[i]
+		result, err := action.execute(progress)
+		release()
+		if err != nil {
+			failed.Store(true)
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		err = j.record(action)
+		if err != nil {
+			failed.Store(true)
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+		err = cp.markDone(i)
+		if err != nil {
+			failed.Store(true)
+			return fmt.Errorf("failed to update checkpoint: %w", err)
+		}
+		p.events.emit(Event{Type: EventAction, Message: result, Action: &records[i]})
+		return nil
+	})
+	wp.stop(nil)
+
+	if err := <-wp.errors(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	if builder.Len() > 0 {
-		fmt.Print(builder.String())
+	completed = true
+	err = cp.finish()
+	if err != nil {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
 	}
 
 	return nil
 }
 
-func (p *Plan) printSummary() error {
-	moveCount := 0
-	copyCount := 0
-	skipCount := 0
-	conflictCount := 0
-	var skippedSummeries strings.Builder
-	var copySummeries strings.Builder
-	var moveSummeries strings.Builder
-	var conflictSummeries strings.Builder
+// Returns the actions of the plan in the order they are applied.
+func (p *Plan) Actions() ([]Action, error) {
+	records := make([]Action, 0, len(p.actions))
+	for _, a := range p.actions {
+		r, err := p.recordAction(a)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
 
-	fmt.Println("Detailed Actions:")
-	for _, action := range p.actions {
-		summery := action.summery()
+// Number of actions of each type in a plan.
+type Summary struct {
+	Moves       int `json:"moves"`
+	Copies      int `json:"copies"`
+	Skips       int `json:"skips"`
+	Conflicts   int `json:"conflicts"`
+	Quarantines int `json:"quarantines"`
+	Deletes     int `json:"deletes"`
+	Links       int `json:"links"`
+	Duplicates  int `json:"duplicates"`
+	// Source files left out by the capture filter
+	Filtered int `json:"filtered"`
+	// Bytes written to the destination when the plan is applied
+	RequiredSpace int64 `json:"requiredSpace"`
+}
 
+func (p *Plan) Summary() (Summary, error) {
+	var summary Summary
+	for _, action := range p.actions {
 		switch action.aType {
-		case move:
-			moveSummeries.WriteString(fmt.Sprintf("  %s\n", summery))
-			moveCount++
-		case copy:
-			copySummeries.WriteString(fmt.Sprintf("  %s\n", summery))
-			copyCount++
-		case skip:
-			skippedSummeries.WriteString(fmt.Sprintf("  %s\n", summery))
-			skipCount++
-		case conflict:
-			conflictSummeries.WriteString(fmt.Sprintf("  %s\n", summery))
-			conflictCount++
-		}
-	}
-	fmt.Print(skippedSummeries.String())
-	fmt.Print(copySummeries.String())
-	fmt.Print(moveSummeries.String())
-	fmt.Print(conflictSummeries.String())
-
-	fmt.Printf("\n")
-	fmt.Printf("Plan Summary:\n")
-	fmt.Printf("  Files to move: %d\n", moveCount)
-	fmt.Printf("  Files to copy: %d\n", copyCount)
-	fmt.Printf("  Files skipped: %d\n", skipCount)
-	if conflictCount > 0 {
-		fmt.Printf("  Detected conflicts: %d (will prevent execution of plan and reported actions might be incorrect)\n", conflictCount)
-	} else {
-		fmt.Printf("  Detected conflicts: %d\n", conflictCount)
-	}
-	fmt.Printf("\n")
+		case ActionMove:
+			summary.Moves++
+		case ActionCopy:
+			summary.Copies++
+		case ActionSkip:
+			summary.Skips++
+		case ActionConflict:
+			summary.Conflicts++
+		case ActionQuarantine:
+			summary.Quarantines++
+		case ActionDelete:
+			summary.Deletes++
+		case ActionLink:
+			summary.Links++
+		case ActionDuplicate:
+			summary.Duplicates++
+		}
+	}
+
+	required, err := p.requiredSpace(makeRange(0, len(p.actions)))
+	if err != nil {
+		return Summary{}, err
+	}
+	summary.RequiredSpace = required
+	summary.Filtered = p.filtered
+
+	return summary, nil
+}
+
+// Order the actions of a plan are listed in, actions of a group are listed together.
+var reportOrder = [][]ActionType{
+	{ActionSkip},
+	{ActionDuplicate},
+	{ActionQuarantine, ActionDelete, ActionLink},
+	{ActionCopy},
+	{ActionMove},
+	{ActionConflict},
+}
+
+// Reports every action of the plan as a planned event, grouped by type, followed
+// by the number of actions of each type.
+func (p *Plan) report(events *emitter) error {
+	records, err := p.Actions()
+	if err != nil {
+		return err
+	}
+	summary, err := p.Summary()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range reportOrder {
+		for i, action := range p.actions {
+			if slices.Contains(group, action.aType) {
+				events.emit(Event{Type: EventPlanned, Message: action.summery(), Action: &records[i]})
+			}
+		}
+	}
+	events.emit(Event{Type: EventPlanSummary, Message: "Plan Summary", Summary: &summary})
 
 	return nil
 }
 
-func CreatePlan(ctx context.Context, sourcePaths []string, destinationPath string, moveMode bool, filter []string, noSooc bool) (Plan, error) {
-	fmt.Println("building execution plan... (depending on disk used and number of files this might take a while)")
-	fmt.Println()
+// Writes every action of the plan followed by the number of actions of each type.
+func (p *Plan) WriteSummary(w io.Writer) error {
+	return p.report(newEmitter(NewTextSink(w, slog.LevelInfo)))
+}
+
+// Scans the sources and the destination and works out the actions that
+// organise the media.
+func (pl *Planner) Plan(ctx context.Context) (_ *Plan, err error) {
+	opts := pl.options
+	fsys := fileSystem(opts.FS)
+	events := newEmitter(opts.Events)
+	defer func() { events.failed(err) }()
+	events.emit(Event{Type: EventPlanning, Message: "building execution plan... (depending on disk used and number of files this might take a while)"})
+
+	filter := opts.Filter
+	if len(filter) == 0 {
+		filter = []string{string(media.JpgMedia), string(media.RafMedia), string(media.MovMedia), string(media.Mp4Media)}
+	}
 
-	mediaMaps, err := prepareMediaMaps(ctx, sourcePaths, destinationPath, filter, noSooc)
+	sources, err := expandCards(fsys, opts.Sources, events)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := scanOptions{
+		filter:         filter,
+		ignore:         ignoreRules{exclude: opts.Exclude, include: opts.Include},
+		capture:        captureFilter{since: opts.Since, until: opts.Until, cameras: opts.Cameras},
+		followSymlinks: opts.FollowSymlinks,
+		noSooc:         opts.NoSooc,
+		dayStartsAt:    opts.DayStartsAt,
+		limits:         opts.ScanLimits,
+		bandwidth:      newBandwidthLimiter(opts.ScanLimits.BytesPerSecond),
+	}
+	mediaMaps, err := prepareMediaMaps(ctx, fsys, sources, opts.Destination, scan, opts.DedupeHardLinks, events)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			return Plan{}, errors.New("Plan creation interrupted")
+			return nil, errors.New("Plan creation interrupted")
 		}
-		return Plan{}, err
+		return nil, err
 	}
 
-	plan := Plan{}
+	plan := &Plan{destinationPath: opts.Destination, options: opts, fsys: fsys, events: events, filtered: mediaMaps.Filtered}
 
-	plan.handleDestinationsConflicts(&mediaMaps)
-	err = plan.handleDestinationFiles(&mediaMaps, destinationPath)
+	err = plan.handleDestinationsConflicts(&mediaMaps, opts.Destination)
+	if err != nil {
+		return nil, err
+	}
+	err = plan.handleDestinationFiles(&mediaMaps, opts.Destination)
 	if err != nil {
-		return Plan{}, err
+		return nil, err
 	}
-	plan.handleSourceFiles(&mediaMaps, moveMode, destinationPath)
+	plan.handleSourceFiles(&mediaMaps, opts.MoveMode, opts.Destination)
+	plan.handleSourceDuplicates(&mediaMaps, opts.MoveMode, opts.SourceDuplicates, opts.Destination)
 
-	err = plan.printSummary()
+	err = plan.report(events)
 	if err != nil {
-		return Plan{}, fmt.Errorf("error occured while printing plan summery: %w", err)
+		return nil, fmt.Errorf("error occured while reporting plan: %w", err)
 	}
 
 	return plan, nil
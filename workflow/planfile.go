@@ -0,0 +1,92 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Plan saved by the plan command, so it can be applied later without scanning
+// the sources and the destination again.
+type PlanFile struct {
+	Sources     []string `json:"sources"`
+	Destination string   `json:"destination"`
+	Actions     []Action `json:"actions"`
+}
+
+// Writes the plan so it can be loaded and applied later.
+func (p *Plan) Save(w io.Writer) error {
+	records, err := p.Actions()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(PlanFile{Sources: p.options.Sources, Destination: p.destinationPath, Actions: records})
+}
+
+func ReadPlanFile(r io.Reader) (PlanFile, error) {
+	var saved PlanFile
+	err := json.NewDecoder(r).Decode(&saved)
+	if err != nil {
+		return PlanFile{}, fmt.Errorf("invalid plan file: %w", err)
+	}
+	if saved.Destination == "" {
+		return PlanFile{}, errors.New("invalid plan file: destination not recorded")
+	}
+	return saved, nil
+}
+
+// Restores a saved plan so it can be applied. Every file the plan changes has
+// to still have the fingerprint it had when the plan was saved, otherwise the
+// plan is out of date and is refused. Of the options only the apply limits,
+// AllowDelete, the file system and the event sink are used.
+func LoadPlan(ctx context.Context, saved PlanFile, options Options) (_ *Plan, err error) {
+	events := newEmitter(options.Events)
+	defer func() { events.failed(err) }()
+
+	fsys := fileSystem(options.FS)
+	options.Sources = saved.Sources
+	options.Destination = saved.Destination
+	plan := &Plan{destinationPath: saved.Destination, options: options, fsys: fsys, events: events}
+
+	for _, r := range saved.Actions {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		if r.Type == ActionConflict {
+			return nil, errors.New("saved plan has conflicts. Resolve them and create the plan again")
+		}
+
+		switch r.Type {
+		case ActionMove, ActionCopy, ActionDelete, ActionQuarantine, ActionLink:
+			err := checkFingerprint(fsys, r.Path, r.Fingerprint)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					err = errors.New("file is missing")
+				}
+				return nil, fmt.Errorf("saved plan is out of date, %s: %w. Create the plan again", r.Path, err)
+			}
+		}
+
+		a, err := actionFromRecord(fsys, r, saved.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore plan: %w", err)
+		}
+		plan.actions = append(plan.actions, a)
+	}
+
+	err = plan.report(events)
+	if err != nil {
+		return nil, fmt.Errorf("error occured while reporting plan: %w", err)
+	}
+
+	return plan, nil
+}
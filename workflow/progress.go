@@ -0,0 +1,197 @@
+package workflow
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// Tracks how many files and bytes of a phase are done and reports it, with the
+// throughput and the time left, as progress events a few times a second. A nil
+// progress reports nothing.
+type progress struct {
+	phase  string
+	unit   string
+	events *emitter
+
+	totalFiles atomic.Int64
+	doneFiles  atomic.Int64
+	totalBytes atomic.Int64
+	doneBytes  atomic.Int64
+	// Set once nothing more is added, the totals are only known from then on
+	allAdded atomic.Bool
+
+	started  time.Time
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Starts reporting the progress of the phase, counting items in unit, e.g. files.
+func newProgress(events *emitter, phase, unit string) *progress {
+	p := &progress{
+		phase:    phase,
+		unit:     unit,
+		events:   events,
+		started:  time.Now(),
+		stopChan: make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopChan:
+				return
+			case <-ticker.C:
+				snapshot := p.snapshot()
+				p.events.emit(Event{Type: EventProgress, Message: snapshot.line(), Progress: &snapshot})
+			}
+		}
+	}()
+
+	return p
+}
+
+// Adds work to the totals.
+func (p *progress) add(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.totalFiles.Add(int64(files))
+	p.totalBytes.Add(bytes)
+}
+
+// Marks the totals as complete so the percentage and time left can be shown.
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.allAdded.Store(true)
+}
+
+func (p *progress) advance(bytes int64) {
+	if p == nil {
+		return
+	}
+	p.doneBytes.Add(bytes)
+}
+
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.doneFiles.Add(1)
+}
+
+// Wraps the reader so the bytes read from it are counted.
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{reader: r, progress: p}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.progress.advance(int64(n))
+	return n, err
+}
+
+// Stops reporting and reports the final totals of the phase.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	close(p.stopChan)
+	p.wg.Wait()
+
+	snapshot := p.snapshot()
+	p.events.emit(Event{Type: EventPhaseDone, Message: snapshot.summary(), Progress: &snapshot})
+}
+
+func (p *progress) snapshot() Progress {
+	return Progress{
+		Phase:      p.phase,
+		Unit:       p.unit,
+		Done:       p.doneFiles.Load(),
+		Total:      p.totalFiles.Load(),
+		DoneBytes:  p.doneBytes.Load(),
+		TotalBytes: p.totalBytes.Load(),
+		Counted:    p.allAdded.Load(),
+		Elapsed:    time.Since(p.started),
+	}
+}
+
+// Describes the totals of a finished phase.
+func (p Progress) summary() string {
+	line := fmt.Sprintf("%s: %d %s", p.Phase, p.Done, p.Unit)
+	if p.DoneBytes > 0 {
+		line += fmt.Sprintf(", %s in %s (%s/s)", formatSize(p.DoneBytes), formatElapsed(p.Elapsed), formatSize(rate(p.DoneBytes, p.Elapsed)))
+	} else {
+		line += fmt.Sprintf(" in %s", formatElapsed(p.Elapsed))
+	}
+	return line
+}
+
+// Describes how far the phase is, how fast it goes and how long it still takes.
+func (p Progress) line() string {
+	line := fmt.Sprintf("%s: %d/%d %s", p.Phase, p.Done, p.Total, p.Unit)
+	if p.TotalBytes > 0 {
+		line += fmt.Sprintf(", %s of %s", formatSize(p.DoneBytes), formatSize(p.TotalBytes))
+	}
+
+	if !p.Counted {
+		if p.DoneBytes > 0 {
+			line += fmt.Sprintf(", %s/s", formatSize(rate(p.DoneBytes, p.Elapsed)))
+		}
+		return line + ", still counting"
+	}
+
+	// Bytes tell the time left better than files, as long as there are any
+	done, total := float64(p.Done), float64(p.Total)
+	if p.TotalBytes > 0 {
+		done, total = float64(p.DoneBytes), float64(p.TotalBytes)
+	}
+	percentage := 100.0
+	if total > 0 {
+		percentage = done / total * 100
+	}
+
+	line += fmt.Sprintf(" (%.0f%%)", percentage)
+	if p.TotalBytes > 0 {
+		line += fmt.Sprintf(", %s/s", formatSize(rate(p.DoneBytes, p.Elapsed)))
+	}
+	if done > 0 && done < total {
+		left := time.Duration(float64(p.Elapsed) * (total - done) / done)
+		line += fmt.Sprintf(", %s left", formatElapsed(left))
+	}
+	return line
+}
+
+func rate(bytes int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / elapsed.Seconds())
+}
+
+func formatElapsed(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,260 @@
+package workflow
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Walks through the conflicts of the plan, and every move and copy when reviewAll
+// is set, asking what should happen to each of them. The plan is edited in place
+// and can be applied afterwards.
+func (p *Plan) Review(ctx context.Context, in io.Reader, out io.Writer, reviewAll bool) error {
+	reader := bufio.NewReader(in)
+
+	conflictCount := countActions(p.actions, ActionConflict)
+	if conflictCount == 0 && !reviewAll {
+		fmt.Fprintln(out, "Nothing to review")
+		fmt.Fprintln(out)
+		return nil
+	}
+
+	fmt.Fprintln(out, "Reviewing plan:")
+
+	var resolved []action
+	// Files that are removed from the library or left untouched by the review.
+	// Moves planned for them no longer apply.
+	var dropped []media.File
+	current := 0
+
+	for _, a := range p.actions {
+		if a.aType != ActionConflict {
+			resolved = append(resolved, a)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		current++
+		resolution, err := p.reviewConflict(reader, out, a, current, conflictCount)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range append([]media.File{a.file}, a.others...) {
+			if !slices.Contains(resolution.kept, f) {
+				dropped = append(dropped, f)
+			}
+		}
+		resolved = append(resolved, resolution.actions...)
+	}
+
+	resolved = slices.DeleteFunc(resolved, func(a action) bool {
+		return a.aType == ActionMove && slices.Contains(dropped, a.file)
+	})
+
+	if reviewAll {
+		transferCount := countActions(resolved, ActionMove) + countActions(resolved, ActionCopy)
+		current = 0
+
+		var reviewed []action
+		for _, a := range resolved {
+			if a.aType != ActionMove && a.aType != ActionCopy {
+				reviewed = append(reviewed, a)
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			current++
+			kept, err := p.reviewTransfer(reader, out, a, current, transferCount)
+			if err != nil {
+				return err
+			}
+			reviewed = append(reviewed, kept...)
+		}
+		resolved = reviewed
+	}
+
+	p.actions = resolved
+
+	return p.WriteSummary(out)
+}
+
+func countActions(actions []action, aType ActionType) int {
+	count := 0
+	for _, a := range actions {
+		if a.aType == aType {
+			count++
+		}
+	}
+	return count
+}
+
+type conflictResolution struct {
+	actions []action
+	kept    []media.File
+}
+
+func (p *Plan) reviewConflict(reader *bufio.Reader, out io.Writer, a action, current, total int) (conflictResolution, error) {
+	files := append([]media.File{a.file}, a.others...)
+
+	fmt.Fprintf(out, "\nConflict %d of %d: %d files have the same contents\n", current, total, len(files))
+	for i, f := range files {
+		fmt.Fprintf(out, "  [%d] %s\n", i+1, f.GetPath())
+		fmt.Fprintf(out, "      %s\n", describeFile(p.fsys, f))
+	}
+
+	answer, err := prompt(reader, out, fmt.Sprintf("Keep file [1-%d] or [s]kip: ", len(files)), func(answer string) bool {
+		if answer == "s" {
+			return true
+		}
+		n, err := strconv.Atoi(answer)
+		return err == nil && n >= 1 && n <= len(files)
+	})
+	if err != nil {
+		return conflictResolution{}, err
+	}
+
+	if answer == "s" {
+		return conflictResolution{}, nil
+	}
+
+	n, _ := strconv.Atoi(answer)
+	keeper := files[n-1]
+
+	disposal, err := prompt(reader, out, "Other copies: [q]uarantine or [d]elete: ", func(answer string) bool {
+		return answer == "q" || answer == "d"
+	})
+	if err != nil {
+		return conflictResolution{}, err
+	}
+
+	var resolution conflictResolution
+	resolution.kept = []media.File{keeper}
+	for _, f := range files {
+		if f == keeper {
+			continue
+		}
+
+		// Deletes still need --confirm-delete, the answer alone doesn't remove files
+		if disposal == "d" {
+			resolution.actions = append(resolution.actions, newDeleteAction(p.fsys, f, fmt.Sprintf("duplicate of %s", keeper.GetPath())))
+		} else {
+			resolution.actions = append(resolution.actions, newQuarantineAction(p.fsys, f, keeper, p.destinationPath))
+		}
+	}
+
+	// The plan only organises the first file of a conflict, so the kept file
+	// needs its own move when it is another one
+	if keeper != a.file {
+		dstPath, err := keeper.GetDestinationPath(p.destinationPath)
+		if err != nil {
+			return conflictResolution{}, fmt.Errorf("%s %w", keeper.GetPath(), err)
+		}
+		if keeper.GetPath() != dstPath {
+			resolution.actions = append(resolution.actions, newMoveAction(p.fsys, keeper, p.destinationPath))
+		}
+	}
+
+	return resolution, nil
+}
+
+func (p *Plan) reviewTransfer(reader *bufio.Reader, out io.Writer, a action, current, total int) ([]action, error) {
+	dstPath, err := a.file.GetDestinationPath(p.destinationPath)
+	if err != nil {
+		dstPath = "unkown"
+	}
+
+	label := "Copy"
+	if a.aType == ActionMove {
+		label = "Move"
+	}
+
+	fmt.Fprintf(out, "\n%s %d of %d\n", label, current, total)
+	fmt.Fprintf(out, "  from: %s\n", a.file.GetPath())
+	fmt.Fprintf(out, "  to:   %s\n", dstPath)
+	fmt.Fprintf(out, "      %s\n", describeFile(p.fsys, a.file))
+
+	// Dropping the action leaves the file where it is, in copy mode it is the
+	// original
+	answer, err := prompt(reader, out, "[k]eep or [d]rop action: ", func(answer string) bool {
+		return answer == "k" || answer == "d"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if answer == "k" {
+		return []action{a}, nil
+	}
+	return nil, nil
+}
+
+func prompt(reader *bufio.Reader, out io.Writer, question string, valid func(answer string) bool) (string, error) {
+	for {
+		fmt.Fprint(out, question)
+
+		line, err := reader.ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		if err != nil && !(errors.Is(err, io.EOF) && answer != "") {
+			if errors.Is(err, io.EOF) {
+				return "", errors.New("review aborted: no more input")
+			}
+			return "", fmt.Errorf("failed to read answer: %w", err)
+		}
+
+		if valid(answer) {
+			return answer, nil
+		}
+		fmt.Fprintf(out, "  invalid answer: %q\n", answer)
+	}
+}
+
+func describeFile(fsys storage.FS, f media.File) string {
+	size := "unknown"
+	if info, err := fsys.Stat(f.GetPath()); err == nil {
+		size = formatSize(info.Size())
+	}
+
+	captured := "unknown"
+	if t, err := f.GetCaptureTime(); err == nil {
+		captured = t.Format("2006-01-02 15:04:05")
+	}
+
+	fingerprint := f.GetFingerprint()
+	if len(fingerprint) > 12 {
+		fingerprint = fingerprint[:12]
+	}
+
+	return fmt.Sprintf("size: %s, captured: %s, fingerprint: %s", size, captured, fingerprint)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= oneGB:
+		return fmt.Sprintf("%.1f GB", float64(size)/oneGB)
+	case size >= oneMB:
+		return fmt.Sprintf("%.1f MB", float64(size)/oneMB)
+	case size >= oneKB:
+		return fmt.Sprintf("%.1f KB", float64(size)/oneKB)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
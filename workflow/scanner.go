@@ -5,48 +5,40 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"math"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
 )
 
-type progressReport struct {
-	Processed int64
-	Total     int64
-}
-
 type workerPool[T any] struct {
-	jobs          chan T
-	errorChan     chan error
-	progressChan  chan progressReport
-	totalJobs     atomic.Int64
-	processedJobs atomic.Int64
-	workerWG      sync.WaitGroup
-	reporterWG    sync.WaitGroup
+	jobs       chan T
+	errorChan  chan error
+	numWorkers int
+	totalJobs  atomic.Int64
+	// Counts a file as done for every processed job, can be nil
+	progress *progress
+	workerWG sync.WaitGroup
 }
 
-func newWorkerPool[T any](jobBufferSize int) *workerPool[T] {
+func newWorkerPool[T any](jobBufferSize, numWorkers int, progress *progress) *workerPool[T] {
 	return &workerPool[T]{
-		jobs:         make(chan T, jobBufferSize),
-		errorChan:    make(chan error, 1), // Buffer of 1 to ensure non-blocking
-		progressChan: make(chan progressReport, 100),
+		jobs:       make(chan T, jobBufferSize),
+		numWorkers: numWorkers,
+		errorChan:  make(chan error, 1), // Buffer of 1 to ensure non-blocking
+		progress:   progress,
 	}
 }
 
 func (wp *workerPool[T]) start(ctx context.Context, workerFunc func(T) error) {
-	numWorkers := runtime.NumCPU() * 2
-
-	wp.reporterWG.Add(1)
-	go wp.startProgressReporter(ctx)
-
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < wp.numWorkers; i++ {
 		wp.workerWG.Add(1)
 		go func() {
 			defer wp.workerWG.Done()
@@ -64,63 +56,18 @@ func (wp *workerPool[T]) start(ctx context.Context, workerFunc func(T) error) {
 						default:
 						}
 					}
-					wp.processedJobs.Add(1)
-					wp.sendProgress()
+					wp.progress.fileDone()
 				}
 			}
 		}()
 	}
 }
 
-func (wp *workerPool[T]) startProgressReporter(ctx context.Context) {
-	defer wp.reporterWG.Done()
-
-	const progressStep = 20.0
-	var lastReportedPercentage float64
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case progress, ok := <-wp.progressChan:
-			if !ok {
-				return
-			}
-
-			if progress.Total == 0 {
-				return
-			}
-
-			currentPercentage := (float64(progress.Processed) / float64(progress.Total)) * 100
-			if currentPercentage >= lastReportedPercentage+progressStep || currentPercentage == 100 {
-				fmt.Printf("  Processed %d/%d files (%.0f%%)\n", progress.Processed, progress.Total, currentPercentage)
-				lastReportedPercentage = currentPercentage - math.Mod(currentPercentage, progressStep)
-			}
-
-			if progress.Processed == progress.Total {
-				return
-			}
-		}
-	}
-}
-
-func (wp *workerPool[T]) sendProgress() {
-	progress := progressReport{
-		Processed: wp.processedJobs.Load(),
-		Total:     wp.totalJobs.Load(),
-	}
-	wp.progressChan <- progress
-}
-
 func (wp *workerPool[T]) stop(optionalFunc func()) {
 	close(wp.jobs)
 	wp.workerWG.Wait()
 
-	wp.sendProgress()
-	wp.reporterWG.Wait()
-
 	close(wp.errorChan)
-	close(wp.progressChan)
 
 	if optionalFunc != nil {
 		optionalFunc()
@@ -132,6 +79,19 @@ func (wp *workerPool[T]) enqueue(job T) {
 	wp.totalJobs.Add(1)
 }
 
+// Adds a job to a pool that is already running, giving up when the context is
+// cancelled while waiting for a free spot in the queue.
+func (wp *workerPool[T]) enqueueContext(ctx context.Context, job T) error {
+	wp.totalJobs.Add(1)
+	select {
+	case <-ctx.Done():
+		wp.totalJobs.Add(-1)
+		return ctx.Err()
+	case wp.jobs <- job:
+		return nil
+	}
+}
+
 func (wp *workerPool[T]) errors() <-chan error {
 	return wp.errorChan
 }
@@ -139,37 +99,64 @@ func (wp *workerPool[T]) errors() <-chan error {
 type MediaMaps struct {
 	SourceMap map[string]media.File
 	DestMap   map[string][]media.File
+	// Source files with the same contents as a file already kept in SourceMap
+	SourceDuplicates []SourceDuplicate
+	// Number of source files left out by the capture filter
+	Filtered int
 }
 
+type SourceDuplicate struct {
+	File media.File
+	Kept media.File
+	// Source directory the duplicate was found in
+	Root string
+}
+
+// Scans the sources with the scan options, and the destination with them
+// without the ignore rules and the capture filter, which only apply to sources.
 func prepareMediaMaps(
 	ctx context.Context,
+	fsys storage.FS,
 	sourcePaths []string,
 	destinationPath string,
-	filter []string,
-	noSooc bool,
+	scan scanOptions,
+	dedupeHardLinks bool,
+	events *emitter,
 ) (MediaMaps, error) {
-	var (
-		sourceMedia      []media.File
-		destinationMedia []media.File
-	)
+	var destinationMedia []media.File
 
+	sourceMap := make(map[string]media.File)
+	var sourceDuplicates []SourceDuplicate
+	filtered := 0
 	for _, sourcePath := range sourcePaths {
-		mediaFiles, err := scanFiles(ctx, sourcePath, filter, noSooc)
+		mediaFiles, left, err := scanFiles(ctx, fsys, sourcePath, scan, events)
 		if err != nil {
 			return MediaMaps{}, fmt.Errorf("error occurred while scanning source directory '%s': %w", sourcePath, err)
 		}
-		sourceMedia = append(sourceMedia, mediaFiles...)
-	}
-
-	sourceMap := make(map[string]media.File)
-	for _, mediaFile := range sourceMedia {
-		fingerprint := mediaFile.GetFingerprint()
-		if _, exists := sourceMap[fingerprint]; !exists {
-			sourceMap[fingerprint] = mediaFile
+		filtered += left
+
+		// Sorted so the same copy is kept on every run
+		slices.SortFunc(mediaFiles, func(a, b media.File) int {
+			return strings.Compare(a.GetPath(), b.GetPath())
+		})
+
+		for _, mediaFile := range mediaFiles {
+			fingerprint := mediaFile.GetFingerprint()
+			if kept, exists := sourceMap[fingerprint]; exists {
+				sourceDuplicates = append(sourceDuplicates, SourceDuplicate{File: mediaFile, Kept: kept, Root: sourcePath})
+			} else {
+				sourceMap[fingerprint] = mediaFile
+			}
 		}
 	}
 
-	destinationMedia, err := scanFiles(ctx, destinationPath, filter, noSooc)
+	// The patterns given for the sources don't apply to the library, files left
+	// out of it would be copied again. Only the default patterns and its own
+	// .shutterpilotignore are used.
+	destinationScan := scan
+	destinationScan.ignore = ignoreRules{}
+	destinationScan.capture = captureFilter{}
+	destinationMedia, _, err := scanFiles(ctx, fsys, destinationPath, destinationScan, events)
 	if err != nil {
 		return MediaMaps{}, fmt.Errorf("error occurred while scanning destination directory '%s': %w", destinationPath, err)
 	}
@@ -179,33 +166,45 @@ func prepareMediaMaps(
 		fingerprint := mediaFile.GetFingerprint()
 		destMap[fingerprint] = append(destMap[fingerprint], mediaFile)
 	}
+	for fingerprint, files := range destMap {
+		slices.SortFunc(files, func(a, b media.File) int {
+			return strings.Compare(a.GetPath(), b.GetPath())
+		})
 
-	fmt.Println()
+		if dedupeHardLinks {
+			destMap[fingerprint], err = withoutHardLinks(fsys, files, destinationPath)
+			if err != nil {
+				return MediaMaps{}, fmt.Errorf("error occurred while looking for hard links in destination directory '%s': %w", destinationPath, err)
+			}
+		}
+	}
 
 	result := MediaMaps{
 		SourceMap: sourceMap,
 		DestMap:   destMap,
 	}
-	err = computeDestinationPaths(ctx, &result, destinationPath)
+
+	err = computeDestinationPaths(ctx, &result, destinationPath, events)
 	if err != nil {
 		return MediaMaps{}, err
 	}
 
-	fmt.Println()
-
 	return MediaMaps{
-		SourceMap: sourceMap,
-		DestMap:   destMap,
+		SourceMap:        sourceMap,
+		DestMap:          destMap,
+		SourceDuplicates: sourceDuplicates,
+		Filtered:         filtered,
 	}, nil
 }
 
-func computeDestinationPaths(ctx context.Context, mediaMaps *MediaMaps, dstPath string) error {
+func computeDestinationPaths(ctx context.Context, mediaMaps *MediaMaps, dstPath string, events *emitter) error {
 	destLen := 0
 	for _, files := range mediaMaps.DestMap {
 		destLen += len(files)
 	}
 	bufferLen := len(mediaMaps.SourceMap) + destLen
-	wp := newWorkerPool[media.File](bufferLen)
+	// Capture times were read while scanning, only the paths are left to work out
+	wp := newWorkerPool[media.File](bufferLen, runtime.NumCPU()*2, nil)
 
 	for _, file := range mediaMaps.SourceMap {
 		select {
@@ -226,7 +225,7 @@ func computeDestinationPaths(ctx context.Context, mediaMaps *MediaMaps, dstPath
 		}
 	}
 
-	fmt.Printf("calculating destinations for %d files\n", wp.totalJobs.Load())
+	events.emit(Event{Type: EventLocating, Message: fmt.Sprintf("calculating destinations for %d files", wp.totalJobs.Load())})
 
 	wp.start(ctx, func(file media.File) error {
 		_, err := file.GetDestinationPath(dstPath)
@@ -247,54 +246,52 @@ func computeDestinationPaths(ctx context.Context, mediaMaps *MediaMaps, dstPath
 	}
 }
 
-func scanFiles(ctx context.Context, dirPath string, filter []string, noSooc bool) ([]media.File, error) {
-	resultsChan := make(chan media.File, 200)
-	var results []media.File
-
-	var paths []string
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		select {
-		case <-ctx.Done():
-			return context.Canceled
-		default:
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
+// Settings of a directory scan.
+type scanOptions struct {
+	// File types to scan
+	filter []string
+	ignore ignoreRules
+	// Leaves out files by when and with what they were captured
+	capture captureFilter
+	// Only reads the metadata of the files instead of also fingerprinting them
+	metadataOnly   bool
+	followSymlinks bool
+	// Layout the destination paths are worked out with
+	noSooc      bool
+	dayStartsAt time.Duration
+	limits      ScanLimits
+	// Shared by all scans of a run, the cap is on the total bandwidth
+	bandwidth *bandwidthLimiter
+}
 
-			ext := strings.ToLower(filepath.Ext(path))
-			filetype := strings.TrimPrefix(ext, ".")
-			if !slices.Contains(filter, filetype) {
-				return nil
-			}
+// Scans the directory for media files. Walking the directory, fingerprinting
+// and reading capture times overlap, and every file is opened only once. The
+// capture time is read first, files the capture filter leaves out are not
+// fingerprinted and only counted in the number returned with the files.
+func scanFiles(ctx context.Context, fsys storage.FS, dirPath string, opts scanOptions, events *emitter) ([]media.File, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			paths = append(paths, path)
+	resultsChan := make(chan media.File, 200)
+	var results []media.File
+	var filtered atomic.Int64
 
-			return nil
-		}
-	})
+	scanWorkers, hashWorkers := opts.limits.forRoot(dirPath)
+	rules, err := opts.ignore.forRoot(fsys, dirPath)
 	if err != nil {
-		return []media.File{}, err
+		return nil, 0, err
 	}
 
-	wp := newWorkerPool[string](len(paths))
+	events.emit(Event{Type: EventScanning, Message: fmt.Sprintf("scanning %s", dirPath), Path: dirPath})
 
-	for _, p := range paths {
-		select {
-		case <-ctx.Done():
-			return []media.File{}, context.Canceled
-		default:
-			wp.enqueue(p)
-		}
+	phase, scanned := "fingerprinting", "fingerprinted"
+	if opts.metadataOnly {
+		phase, scanned = "reading metadata", "read"
 	}
+	progress := newProgress(events, phase, "files")
+	defer progress.finish()
 
-	fmt.Printf("scanning %s: %d files\n", dirPath, wp.totalJobs.Load())
-
+	wp := newWorkerPool[string](hashWorkers*2, hashWorkers, progress)
 	wp.start(ctx, func(path string) error {
 		ext := strings.ToLower(filepath.Ext(path))
 		filetype := strings.TrimPrefix(ext, ".")
@@ -302,21 +299,57 @@ func scanFiles(ctx context.Context, dirPath string, filter []string, noSooc bool
 		var m media.File
 		switch media.MediaType(filetype) {
 		case media.JpgMedia:
-			m = media.NewJpg(path, noSooc)
+			m = media.NewJpg(fsys, path, opts.noSooc, opts.dayStartsAt)
 		case media.RafMedia:
-			m = media.NewRaf(path)
-		case media.MovMedia:
-			m = media.NewMov(path)
+			m = media.NewRaf(fsys, path, opts.dayStartsAt)
+		case media.MovMedia, media.Mp4Media:
+			m = media.NewMov(fsys, path, opts.dayStartsAt)
 		default:
 			return fmt.Errorf("unsupported media type: %s", path)
 		}
 
-		hash, err := partialHash(path)
+		file, err := fsys.Open(path)
 		if err != nil {
-			return fmt.Errorf("error calculating partial hash for %s: %w", path, err)
+			return fmt.Errorf("error calculating partial hash for %s: failed to open file: %w", path, err)
+		}
+		defer file.Close()
+
+		// Files without a capture time are reported once their destination is
+		// worked out, the error is kept until then
+		m.LoadCaptureTime(file)
+		if !opts.capture.keeps(m) {
+			if !opts.metadataOnly {
+				info, err := file.Stat()
+				if err != nil {
+					return fmt.Errorf("failed to get file info of %s: %w", path, err)
+				}
+				progress.advance(hashedSize(info.Size()))
+			}
+			filtered.Add(1)
+			events.emit(Event{Type: EventFiltered, Message: fmt.Sprintf("left out %s", path), Path: path})
+			return nil
 		}
 
-		m.SetFingerprint(hash)
+		if !opts.metadataOnly {
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("error calculating partial hash for %s: %w", path, err)
+			}
+
+			hash, err := storedFingerprint(fsys, file, path, progress)
+			if err != nil {
+				return err
+			}
+			if hash == "" {
+				hash, err = hashFile(ctx, file, opts.bandwidth, progress)
+				if err != nil {
+					return fmt.Errorf("error calculating partial hash for %s: %w", path, err)
+				}
+			}
+
+			m.SetFingerprint(hash)
+		}
+		events.emit(Event{Type: EventFileScanned, Message: fmt.Sprintf("%s %s", scanned, path), Path: path})
 
 		select {
 		case resultsChan <- m:
@@ -327,28 +360,192 @@ func scanFiles(ctx context.Context, dirPath string, filter []string, noSooc bool
 		return nil
 	})
 
-	go wp.stop(func() {
-		close(resultsChan)
-	})
-
+	walkErr := make(chan error, 1)
+	go func() {
+		err := walkFiles(ctx, fsys, dirPath, opts.filter, rules, opts.followSymlinks, scanWorkers, func(path string, size int64) error {
+			if opts.metadataOnly {
+				size = 0
+			}
+			progress.add(1, hashedSize(size))
+			return wp.enqueueContext(ctx, path)
+		})
+		progress.done()
+		wp.stop(func() {
+			close(resultsChan)
+		})
+		walkErr <- err
+	}()
+
+	errs := wp.errors()
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
-		case err, ok := <-wp.errors():
+			return nil, 0, ctx.Err()
+		case err, ok := <-errs:
 			if !ok {
-				return results, nil
+				// Results may still be buffered, keep reading until they are drained
+				errs = nil
+				continue
 			}
-			return nil, err
+			return nil, 0, err
 		case m, ok := <-resultsChan:
 			if !ok {
-				return results, nil
+				err := <-walkErr
+				if err != nil {
+					return []media.File{}, 0, err
+				}
+				return results, int(filtered.Load()), nil
 			}
 			results = append(results, m)
 		}
 	}
 }
 
+// Links followed on the way to a directory before it is skipped, like the
+// limit of the OS. File systems that can't tell whether two directories are the
+// same rely on it to stop loops.
+const maxFollowedLinks = 40
+
+// Calls found for every file in the directory and its subdirectories that
+// matches the filter and isn't left out by the rules, reading up to workers
+// directories at the same time. Links to files are read through, links to
+// directories are only walked into when followed.
+func walkFiles(ctx context.Context, fsys storage.FS, dirPath string, filter []string, rules ignoreRules, followSymlinks bool, workers int, found func(path string, size int64) error) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	slots := make(chan struct{}, max(workers, 1))
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	// Directories from the root down to the one being walked, compared with the
+	// directories links point to so a link back up is not walked forever
+	var walk func(dir string, parents []fs.FileInfo, links int)
+	walk = func(dir string, parents []fs.FileInfo, links int) {
+		defer wg.Done()
+
+		select {
+		case <-ctx.Done():
+			fail(context.Canceled)
+			return
+		case slots <- struct{}{}:
+		}
+		if failed() {
+			<-slots
+			return
+		}
+		entries, err := fsys.ReadDir(dir)
+		<-slots
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			rel, err := filepath.Rel(dirPath, path)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			var info fs.FileInfo
+			isDir := entry.IsDir()
+			isLink := entry.Type()&fs.ModeSymlink != 0
+			if isLink {
+				// Links are judged by what they point to, broken ones are skipped
+				info, err = fsys.Stat(path)
+				if err != nil {
+					continue
+				}
+				isDir = info.IsDir()
+				if isDir && (!followSymlinks || links >= maxFollowedLinks) {
+					continue
+				}
+			}
+			if rules.excluded(filepath.ToSlash(rel), isDir) {
+				continue
+			}
+
+			if isDir {
+				if entry.Name() == stateDirName {
+					continue
+				}
+
+				var below []fs.FileInfo
+				if followSymlinks {
+					if info == nil {
+						info, err = entry.Info()
+						if err != nil {
+							fail(err)
+							return
+						}
+					}
+					if slices.ContainsFunc(parents, func(p fs.FileInfo) bool { return fsys.SameFile(p, info) }) {
+						continue
+					}
+					below = append(slices.Clip(parents), info)
+				}
+
+				wg.Add(1)
+				if isLink {
+					go walk(path, below, links+1)
+				} else {
+					go walk(path, below, links)
+				}
+				continue
+			}
+
+			ext := strings.ToLower(filepath.Ext(path))
+			filetype := strings.TrimPrefix(ext, ".")
+			if !slices.Contains(filter, filetype) {
+				continue
+			}
+
+			if info == nil {
+				info, err = entry.Info()
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+			err = found(path, info.Size())
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+
+	var root []fs.FileInfo
+	if followSymlinks {
+		info, err := fsys.Stat(dirPath)
+		if err != nil {
+			return err
+		}
+		root = []fs.FileInfo{info}
+	}
+
+	wg.Add(1)
+	walk(dirPath, root, 0)
+	wg.Wait()
+
+	return firstErr
+}
+
 func calculateChunkSize(fileSize int64) int64 {
 	const minChunkSize = oneMB
 	const maxChunkSize = 10 * oneMB
@@ -365,14 +562,50 @@ func calculateChunkSize(fileSize int64) int64 {
 	return chunkSize
 }
 
+// Returns the fingerprint the file system kept with the file, which saves
+// reading it, or an empty one when it has to be calculated.
+func storedFingerprint(fsys storage.FS, file storage.File, path string, progress *progress) (string, error) {
+	store, ok := fsys.(storage.FingerprintStore)
+	if !ok {
+		return "", nil
+	}
+
+	fingerprint, err := store.Fingerprint(path)
+	if err != nil || fingerprint == "" {
+		return "", err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info of %s: %w", path, err)
+	}
+	progress.advance(hashedSize(info.Size()))
+	return fingerprint, nil
+}
+
 // Calculates the hash of the first and last chunks of a file.
-func partialHash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+func partialHash(fsys storage.FS, filePath string) (string, error) {
+	file, err := fsys.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
+	return hashFile(context.Background(), file, nil, nil)
+}
+
+// Returns how many bytes are read to fingerprint a file of the given size.
+func hashedSize(fileSize int64) int64 {
+	chunkSize := calculateChunkSize(fileSize)
+	if fileSize > chunkSize {
+		return 2 * chunkSize
+	}
+	return fileSize
+}
+
+// Calculates the hash of the first and last chunks of an open file, reading no
+// faster than the bandwidth limiter allows.
+func hashFile(ctx context.Context, file storage.File, bandwidth *bandwidthLimiter, progress *progress) (string, error) {
 	// Get file size
 	fileInfo, err := file.Stat()
 	if err != nil {
@@ -385,10 +618,15 @@ func partialHash(filePath string) (string, error) {
 	buf := make([]byte, chunkSize)
 
 	// Read the first chunk
-	_, err = file.Read(buf)
+	err = bandwidth.take(ctx, min(chunkSize, fileSize))
+	if err != nil {
+		return "", err
+	}
+	n, err := file.Read(buf)
 	if err != nil && err != io.EOF {
 		return "", fmt.Errorf("failed to read first chunk: %w", err)
 	}
+	progress.advance(int64(n))
 	hasher.Write(buf)
 
 	// Seek to the last chunk
@@ -398,10 +636,15 @@ func partialHash(filePath string) (string, error) {
 			return "", fmt.Errorf("failed to seek to last chunk: %w", err)
 		}
 
-		_, err = file.Read(buf)
+		err = bandwidth.take(ctx, chunkSize)
+		if err != nil {
+			return "", err
+		}
+		n, err = file.Read(buf)
 		if err != nil && err != io.EOF {
 			return "", fmt.Errorf("failed to read last chunk: %w", err)
 		}
+		progress.advance(int64(n))
 		hasher.Write(buf)
 	}
 
@@ -0,0 +1,176 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Limits how many actions of a plan are applied at the same time and how full
+// the destination may get.
+type ApplyLimits struct {
+	// Actions applied at the same time
+	Workers int
+	// Actions reading from or writing to the same device at the same time. Zero
+	// means no limit.
+	PerDevice int
+	// Bytes that should stay free at the destination, less only gives a warning
+	SpaceMargin int64
+}
+
+// Paths an action reads or writes. Actions sharing a path have to run in the
+// order of the plan, e.g. a duplicate is quarantined before another file is
+// moved to its place and a source file is only removed after it was imported.
+func (p *Plan) touchedPaths(a action) ([]string, error) {
+	r, err := p.recordAction(a)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := append([]string{r.Path}, r.Others...)
+	if r.Target != "" {
+		paths = append(paths, r.Target)
+	}
+	if r.ImportedAt != "" {
+		paths = append(paths, r.ImportedAt)
+	}
+
+	for i, path := range paths {
+		abs, err := storage.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = abs
+	}
+	return paths, nil
+}
+
+type schedule struct {
+	// Earlier actions that have to finish before the action can start
+	dependencies map[int][]int
+	// Devices the action reads from or writes to
+	devices map[int][]string
+	// Bytes the action writes
+	bytes map[int]int64
+}
+
+func (p *Plan) newSchedule(indexes []int) (schedule, error) {
+	s := schedule{
+		dependencies: make(map[int][]int),
+		devices:      make(map[int][]string),
+		bytes:        make(map[int]int64),
+	}
+	lastTouched := make(map[string]int)
+	devices := make(map[string]string)
+
+	for _, i := range indexes {
+		paths, err := p.touchedPaths(p.actions[i])
+		if err != nil {
+			return schedule{}, err
+		}
+
+		for _, path := range paths {
+			if last, ok := lastTouched[path]; ok && last != i && !slices.Contains(s.dependencies[i], last) {
+				s.dependencies[i] = append(s.dependencies[i], last)
+			}
+			lastTouched[path] = i
+
+			device, err := deviceOf(p.fsys, filepath.Dir(path), devices)
+			if err != nil {
+				return schedule{}, err
+			}
+			if !slices.Contains(s.devices[i], device) {
+				s.devices[i] = append(s.devices[i], device)
+			}
+		}
+		// Devices are always acquired in the same order so actions waiting
+		// for each other's devices can't block forever
+		slices.Sort(s.devices[i])
+
+		s.bytes[i], err = transferredBytes(p.fsys, p.actions[i], devices)
+		if err != nil {
+			return schedule{}, err
+		}
+	}
+
+	return s, nil
+}
+
+// Returns the device of the directory, or of its closest parent that exists
+// when the directory is yet to be created.
+func deviceOf(fsys storage.FS, dir string, cache map[string]string) (string, error) {
+	if device, ok := cache[dir]; ok {
+		return device, nil
+	}
+
+	info, err := fsys.Stat(dir)
+	var device string
+	switch {
+	case err == nil:
+		device = fsys.DeviceID(dir, info)
+	case errors.Is(err, os.ErrNotExist) && filepath.Dir(dir) != dir:
+		device, err = deviceOf(fsys, filepath.Dir(dir), cache)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+
+	cache[dir] = device
+	return device, nil
+}
+
+type deviceLimiter struct {
+	perDevice int
+	mu        sync.Mutex
+	slots     map[string]chan struct{}
+}
+
+func newDeviceLimiter(perDevice int) *deviceLimiter {
+	return &deviceLimiter{perDevice: perDevice, slots: make(map[string]chan struct{})}
+}
+
+func (l *deviceLimiter) deviceSlots(device string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots, ok := l.slots[device]
+	if !ok {
+		slots = make(chan struct{}, l.perDevice)
+		l.slots[device] = slots
+	}
+	return slots
+}
+
+// Waits for a free slot on every device and returns a function releasing them.
+func (l *deviceLimiter) acquire(ctx context.Context, devices []string) (func(), error) {
+	if l.perDevice <= 0 {
+		return func() {}, nil
+	}
+
+	var acquired []chan struct{}
+	release := func() {
+		for _, slots := range acquired {
+			<-slots
+		}
+	}
+
+	for _, device := range devices {
+		slots := l.deviceSlots(device)
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case slots <- struct{}{}:
+			acquired = append(acquired, slots)
+		}
+	}
+
+	return release, nil
+}
@@ -0,0 +1,314 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	logProgressInterval  = 10 * time.Second
+	jsonProgressInterval = time.Second
+)
+
+// Sink that drops every event, for runs that should print nothing.
+var Discard EventSink = EventHandler(func(Event) {})
+
+// Writes events as text, the way the command line shows them. On a terminal the
+// progress of the running phase is a single line that is updated in place,
+// otherwise a line is logged every few seconds. Error events are left out, the
+// caller reports the error that is returned.
+type TextSink struct {
+	out io.Writer
+	// Events below the level are left out
+	level slog.Level
+	live  bool
+	// Progress line currently shown on the terminal
+	progressLine string
+	// How long the phase had been running when its progress was last logged
+	loggedAt time.Duration
+	// Set while the actions of a plan are being listed
+	listing bool
+	// Set while the duplicate sets of a dedupe run are being listed
+	listingSets bool
+}
+
+func NewTextSink(w io.Writer, level slog.Level) *TextSink {
+	s := &TextSink{out: w, level: level}
+	if f, ok := w.(*os.File); ok {
+		s.live = isTerminal(f)
+	}
+	return s
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (s *TextSink) Handle(e Event) {
+	if e.Level < s.level || e.Type == EventError {
+		return
+	}
+
+	switch e.Type {
+	case EventProgress:
+		if s.live {
+			s.progressLine = "  " + e.Message
+			fmt.Fprint(s.out, "\r\033[K"+s.progressLine)
+		} else if e.Progress.Elapsed-s.loggedAt >= logProgressInterval {
+			fmt.Fprintln(s.out, "  "+e.Message)
+			s.loggedAt = e.Progress.Elapsed
+		}
+		return
+	case EventPhaseDone:
+		s.clearProgress()
+		s.progressLine = ""
+		s.loggedAt = 0
+		fmt.Fprintln(s.out, "  "+e.Message)
+		return
+	}
+
+	// Printed above the progress line so it is not broken up
+	s.clearProgress()
+	switch e.Type {
+	case EventPlanning:
+		fmt.Fprintln(s.out, e.Message)
+		fmt.Fprintln(s.out)
+	case EventLocating, EventCardMounted:
+		fmt.Fprintln(s.out)
+		fmt.Fprintln(s.out, e.Message)
+	case EventScanning, EventApplying, EventResuming, EventUndoing, EventVerifying, EventWatching, EventCardImported, EventCardSkipped, EventCardFailed:
+		fmt.Fprintln(s.out, e.Message)
+	case EventPlanned:
+		s.startListing()
+		fmt.Fprintln(s.out, "  "+e.Message)
+	case EventPlanSummary:
+		// A plan without actions still gets the heading
+		s.startListing()
+		s.listing = false
+		writePlanSummary(s.out, *e.Summary)
+	case EventUndone:
+		writeUndoSummary(s.out, *e.UndoSummary)
+	case EventVerifySummary:
+		writeVerifySummary(s.out, *e.VerifySummary)
+	case EventDuplicateSet:
+		if !s.listingSets {
+			s.listingSets = true
+			fmt.Fprintln(s.out)
+			fmt.Fprintln(s.out, "Duplicate Sets:")
+		}
+		writeDuplicateSet(s.out, *e.Duplicates)
+	case EventDedupeSummary:
+		s.listingSets = false
+		writeDedupeSummary(s.out, *e.DedupeSummary)
+	case EventStats:
+		writeStats(s.out, *e.Stats)
+	default:
+		fmt.Fprintln(s.out, "  "+e.Message)
+	}
+	if s.progressLine != "" {
+		fmt.Fprint(s.out, s.progressLine)
+	}
+}
+
+func (s *TextSink) startListing() {
+	if s.listing {
+		return
+	}
+	s.listing = true
+	fmt.Fprintln(s.out)
+	fmt.Fprintln(s.out, "Detailed Actions:")
+}
+
+func (s *TextSink) clearProgress() {
+	if s.live && s.progressLine != "" {
+		fmt.Fprint(s.out, "\r\033[K")
+	}
+}
+
+func writePlanSummary(w io.Writer, summary Summary) {
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Plan Summary:\n")
+	fmt.Fprintf(w, "  Files to move: %d\n", summary.Moves)
+	fmt.Fprintf(w, "  Files to copy: %d\n", summary.Copies)
+	fmt.Fprintf(w, "  Files skipped: %d\n", summary.Skips)
+	if summary.Duplicates > 0 {
+		fmt.Fprintf(w, "  Duplicates in sources: %d\n", summary.Duplicates)
+	}
+	if summary.Filtered > 0 {
+		fmt.Fprintf(w, "  Files left out by filters: %d\n", summary.Filtered)
+	}
+	if summary.Quarantines+summary.Deletes+summary.Links > 0 {
+		fmt.Fprintf(w, "  Files to quarantine: %d\n", summary.Quarantines)
+		fmt.Fprintf(w, "  Files to delete: %d\n", summary.Deletes)
+		fmt.Fprintf(w, "  Files to link: %d\n", summary.Links)
+	}
+	if summary.Conflicts > 0 {
+		fmt.Fprintf(w, "  Detected conflicts: %d (will prevent execution of plan and reported actions might be incorrect)\n", summary.Conflicts)
+	} else {
+		fmt.Fprintf(w, "  Detected conflicts: %d\n", summary.Conflicts)
+	}
+	if summary.RequiredSpace > 0 {
+		fmt.Fprintf(w, "  Space needed at destination: %s\n", formatSize(summary.RequiredSpace))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func writeUndoSummary(w io.Writer, summary UndoSummary) {
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Undo Summary:\n")
+	fmt.Fprintf(w, "  Files restored: %d\n", summary.Restored)
+	fmt.Fprintf(w, "  Copies removed: %d\n", summary.Removed)
+	fmt.Fprintf(w, "  Files skipped: %d\n", summary.Skipped)
+}
+
+func writeVerifySummary(w io.Writer, summary VerifySummary) {
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Verify Summary:\n")
+	fmt.Fprintf(w, "  Files intact: %d\n", summary.Verified)
+	fmt.Fprintf(w, "  Files damaged: %d\n", summary.Damaged)
+	fmt.Fprintf(w, "  Files missing: %d\n", summary.Missing)
+}
+
+func writeDuplicateSet(w io.Writer, set DuplicateSet) {
+	fingerprint := set.Fingerprint
+	if len(fingerprint) > 12 {
+		fingerprint = fingerprint[:12]
+	}
+
+	fmt.Fprintf(w, "  %s: %d files of %s each, %s reclaimable\n", fingerprint, len(set.Copies)+1, formatSize(set.Size), formatSize(set.Reclaimable))
+	fmt.Fprintf(w, "    keep: %s\n", set.Kept)
+	for _, path := range set.Copies {
+		fmt.Fprintf(w, "    copy: %s\n", path)
+	}
+}
+
+func writeDedupeSummary(w io.Writer, summary DedupeSummary) {
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Dedupe Summary:\n")
+	fmt.Fprintf(w, "  Duplicate sets: %d\n", summary.Sets)
+	fmt.Fprintf(w, "  Duplicate copies: %d\n", summary.Copies)
+	fmt.Fprintf(w, "  Reclaimable space: %s\n", formatSize(summary.Reclaimable))
+}
+
+// Writes the statistics as tables, followed by the files that need attention.
+func writeStats(w io.Writer, stats LibraryStats) {
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Library Statistics:\n")
+	fmt.Fprintf(w, "  Total: %d files, %s\n", stats.Total.Files, formatSize(stats.Total.Bytes))
+
+	tables := []struct {
+		heading string
+		groups  []StatsGroup
+	}{
+		{"Year", stats.Years},
+		{"Month", stats.Months},
+		{"Type", stats.MediaTypes},
+		{"Camera", stats.Cameras},
+		{"Lens", stats.Lenses},
+		{"Largest day", stats.LargestDays},
+	}
+	for _, table := range tables {
+		if len(table.groups) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "  %s\t\tFiles\tSize\t\n", table.heading)
+		for _, g := range table.groups {
+			fmt.Fprintf(tw, "  %s\t\t%d\t%s\t\n", g.Key, g.Files, formatSize(g.Bytes))
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "  Files not at their destination: %d\n", len(stats.Misplaced))
+	for _, m := range stats.Misplaced {
+		fmt.Fprintf(w, "    %s (belongs at %s)\n", m.Path, m.Destination)
+	}
+	fmt.Fprintf(w, "  Files missing a RAW/JPG partner: %d\n", len(stats.Unpaired))
+	for _, path := range stats.Unpaired {
+		fmt.Fprintf(w, "    %s\n", path)
+	}
+	if len(stats.Undated) > 0 {
+		fmt.Fprintf(w, "  Files without a capture time: %d\n", len(stats.Undated))
+		for _, path := range stats.Undated {
+			fmt.Fprintf(w, "    %s\n", path)
+		}
+	}
+}
+
+// Writes every event as a JSON object on its own line, for scripts that follow
+// a run. Progress is written once a second.
+type JSONSink struct {
+	encoder *json.Encoder
+	// Events below the level are left out
+	level slog.Level
+	// How long the phase had been running when its progress was last written
+	loggedAt time.Duration
+}
+
+func NewJSONSink(w io.Writer, level slog.Level) *JSONSink {
+	return &JSONSink{encoder: json.NewEncoder(w), level: level}
+}
+
+type jsonEvent struct {
+	Time          time.Time      `json:"time"`
+	Level         slog.Level     `json:"level"`
+	Type          EventType      `json:"type"`
+	Message       string         `json:"message,omitempty"`
+	Path          string         `json:"path,omitempty"`
+	Action        *Action        `json:"action,omitempty"`
+	Progress      *Progress      `json:"progress,omitempty"`
+	Summary       *Summary       `json:"summary,omitempty"`
+	UndoSummary   *UndoSummary   `json:"undoSummary,omitempty"`
+	VerifySummary *VerifySummary `json:"verifySummary,omitempty"`
+	Duplicates    *DuplicateSet  `json:"duplicates,omitempty"`
+	DedupeSummary *DedupeSummary `json:"dedupeSummary,omitempty"`
+	Stats         *LibraryStats  `json:"stats,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+func (s *JSONSink) Handle(e Event) {
+	if e.Level < s.level {
+		return
+	}
+
+	switch e.Type {
+	case EventProgress:
+		if e.Progress.Elapsed-s.loggedAt < jsonProgressInterval {
+			return
+		}
+		s.loggedAt = e.Progress.Elapsed
+	case EventPhaseDone:
+		s.loggedAt = 0
+	}
+
+	je := jsonEvent{
+		Time:          e.Time,
+		Level:         e.Level,
+		Type:          e.Type,
+		Message:       e.Message,
+		Path:          e.Path,
+		Action:        e.Action,
+		Progress:      e.Progress,
+		Summary:       e.Summary,
+		UndoSummary:   e.UndoSummary,
+		VerifySummary: e.VerifySummary,
+		Duplicates:    e.Duplicates,
+		DedupeSummary: e.DedupeSummary,
+		Stats:         e.Stats,
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+
+	// A sink has no way to report the error, the run goes on without the line
+	_ = s.encoder.Encode(je)
+}
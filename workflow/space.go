@@ -0,0 +1,106 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Returns the bytes the action writes, which is the size of the file for
+// copies and for moves to another device. Renames on the same device don't
+// take any space.
+func transferredBytes(fsys storage.FS, a action, devices map[string]string) (int64, error) {
+	if a.aType != ActionCopy && a.aType != ActionMove {
+		return 0, nil
+	}
+
+	info, err := fsys.Stat(a.file.GetPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// A missing file fails once the action runs
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if a.aType == ActionMove {
+		target, err := a.target()
+		if err != nil {
+			return 0, err
+		}
+		sourceDevice, err := deviceOf(fsys, filepath.Dir(a.file.GetPath()), devices)
+		if err != nil {
+			return 0, err
+		}
+		targetDevice, err := deviceOf(fsys, filepath.Dir(target), devices)
+		if err != nil {
+			return 0, err
+		}
+		if sourceDevice == targetDevice {
+			return 0, nil
+		}
+	}
+
+	return info.Size(), nil
+}
+
+// Returns the bytes the actions at the given indexes write to the destination.
+func (p *Plan) requiredSpace(indexes []int) (int64, error) {
+	devices := make(map[string]string)
+
+	var total int64
+	for _, i := range indexes {
+		bytes, err := transferredBytes(p.fsys, p.actions[i], devices)
+		if err != nil {
+			return 0, fmt.Errorf("%s %w", p.actions[i].file.GetPath(), err)
+		}
+		total += bytes
+	}
+	return total, nil
+}
+
+// Reports whether the destination has room for the actions at the given
+// indexes. A warning is reported when less than the margin would be left.
+func (p *Plan) checkFreeSpace(indexes []int, margin int64) (bool, error) {
+	required, err := p.requiredSpace(indexes)
+	if err != nil {
+		return false, fmt.Errorf("failed to work out the space needed: %w", err)
+	}
+	if required == 0 {
+		return true, nil
+	}
+
+	available, err := p.fsys.FreeSpace(p.destinationPath)
+	if errors.Is(err, errors.ErrUnsupported) {
+		p.events.emit(Event{
+			Type:    EventWarning,
+			Message: fmt.Sprintf("Warning: free space of %s is unknown, make sure %s fit", p.destinationPath, formatSize(required)),
+			Path:    p.destinationPath,
+		})
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get free space of %s: %w", p.destinationPath, err)
+	}
+
+	if uint64(required) > available {
+		p.events.emit(Event{
+			Type:    EventBlocked,
+			Message: fmt.Sprintf("Not enough free space in %s: %s needed, %s available. Free up space and rerun application to continue.", p.destinationPath, formatSize(required), formatSize(int64(available))),
+			Path:    p.destinationPath,
+		})
+		return false, nil
+	}
+	if available-uint64(required) < uint64(margin) {
+		p.events.emit(Event{
+			Type:    EventWarning,
+			Message: fmt.Sprintf("Warning: only %s will be left free in %s after applying the plan", formatSize(int64(available-uint64(required))), p.destinationPath),
+			Path:    p.destinationPath,
+		})
+	}
+
+	return true, nil
+}
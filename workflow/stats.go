@@ -0,0 +1,222 @@
+package workflow
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/media"
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Key of the files whose capture time, camera or lens isn't recorded.
+const unknownKey = "unknown"
+
+type StatsOptions struct {
+	// Library to report on
+	Destination string
+	// File types to count, all of them when empty
+	Filter []string
+	// Glob patterns of files and directories to leave out of the scan, like the
+	// ones of Options
+	Exclude []string
+	Include []string
+	// Scans the directories symbolic links point to
+	FollowSymlinks bool
+	// Layout the library is organised with, which tells the files that are not
+	// at their destination path
+	NoSooc      bool
+	DayStartsAt time.Duration
+	ScanLimits  ScanLimits
+	// Number of days listed among the largest ones, none when zero
+	LargestDays int
+	// Receives the progress and the statistics, can be nil
+	Events EventSink
+	// File system of the library, the one of the OS when nil
+	FS storage.FS
+}
+
+// Number of files and the bytes they take up.
+type Tally struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Files that have something in common, e.g. the year they were captured in.
+type StatsGroup struct {
+	Key string `json:"key"`
+	Tally
+}
+
+// File that is not at the path the library is organised by.
+type MisplacedFile struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+}
+
+// Statistics of the media in a library. Days, months and years are the ones
+// media is filed under.
+type LibraryStats struct {
+	Total  Tally        `json:"total"`
+	Years  []StatsGroup `json:"years"`
+	Months []StatsGroup `json:"months"`
+	// By file extension, e.g. raf
+	MediaTypes []StatsGroup `json:"mediaTypes"`
+	Cameras    []StatsGroup `json:"cameras"`
+	Lenses     []StatsGroup `json:"lenses"`
+	// Days with the most bytes, largest first
+	LargestDays []StatsGroup    `json:"largestDays"`
+	Misplaced   []MisplacedFile `json:"misplaced"`
+	// Raw photos without a JPG with the same name on the same day, and JPGs
+	// without a raw photo
+	Unpaired []string `json:"unpaired"`
+	// Files without a capture time, they can't be organised
+	Undated []string `json:"undated"`
+}
+
+// Scans the library and counts its media by when, with what and as what it was
+// captured, and lists the files that need attention. The statistics are also
+// reported in an event.
+func CollectStats(ctx context.Context, options StatsOptions) (_ LibraryStats, err error) {
+	fsys := fileSystem(options.FS)
+	events := newEmitter(options.Events)
+	defer func() { events.failed(err) }()
+	events.emit(Event{Type: EventPlanning, Message: "collecting statistics... (depending on disk used and number of files this might take a while)"})
+
+	filter := options.Filter
+	if len(filter) == 0 {
+		filter = []string{string(media.JpgMedia), string(media.RafMedia), string(media.MovMedia), string(media.Mp4Media)}
+	}
+	scan := scanOptions{
+		filter: filter,
+		ignore: ignoreRules{exclude: options.Exclude, include: options.Include},
+		// Statistics don't need fingerprints
+		metadataOnly:   true,
+		followSymlinks: options.FollowSymlinks,
+		noSooc:         options.NoSooc,
+		dayStartsAt:    options.DayStartsAt,
+		limits:         options.ScanLimits,
+		bandwidth:      newBandwidthLimiter(options.ScanLimits.BytesPerSecond),
+	}
+
+	files, _, err := scanFiles(ctx, fsys, options.Destination, scan, events)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return LibraryStats{}, errors.New("Statistics collection interrupted")
+		}
+		return LibraryStats{}, fmt.Errorf("error occurred while scanning library '%s': %w", options.Destination, err)
+	}
+	slices.SortFunc(files, func(a, b media.File) int {
+		return strings.Compare(a.GetPath(), b.GetPath())
+	})
+
+	// Empty lists rather than null ones for dashboards reading the JSON
+	stats := LibraryStats{Misplaced: []MisplacedFile{}, Unpaired: []string{}, Undated: []string{}}
+	years := make(map[string]Tally)
+	months := make(map[string]Tally)
+	days := make(map[string]Tally)
+	mediaTypes := make(map[string]Tally)
+	cameras := make(map[string]Tally)
+	lenses := make(map[string]Tally)
+	// Raw photos and JPGs by day and name, to find the ones without a partner
+	pairs := make(map[string][]media.File)
+
+	for _, f := range files {
+		info, err := fsys.Stat(f.GetPath())
+		if err != nil {
+			return LibraryStats{}, err
+		}
+		size := info.Size()
+		stats.Total = stats.Total.add(size)
+
+		mediaType := strings.ToLower(strings.TrimPrefix(filepath.Ext(f.GetPath()), "."))
+		mediaTypes[mediaType] = mediaTypes[mediaType].add(size)
+
+		camera, lens := unknownKey, unknownKey
+		if c, ok := f.(media.CameraFile); ok {
+			camera = cmp.Or(c.GetCamera(), unknownKey)
+			lens = cmp.Or(c.GetLens(), unknownKey)
+		}
+		cameras[camera] = cameras[camera].add(size)
+		lenses[lens] = lenses[lens].add(size)
+
+		captured, err := f.GetCaptureTime()
+		if err != nil {
+			stats.Undated = append(stats.Undated, f.GetPath())
+			years[unknownKey] = years[unknownKey].add(size)
+			months[unknownKey] = months[unknownKey].add(size)
+			continue
+		}
+		day := captured.Add(-options.DayStartsAt)
+		years[day.Format("2006")] = years[day.Format("2006")].add(size)
+		months[day.Format("2006-01")] = months[day.Format("2006-01")].add(size)
+		days[day.Format("2006-01-02")] = days[day.Format("2006-01-02")].add(size)
+
+		dstPath, err := f.GetDestinationPath(options.Destination)
+		if err == nil && dstPath != f.GetPath() {
+			stats.Misplaced = append(stats.Misplaced, MisplacedFile{Path: f.GetPath(), Destination: dstPath})
+		}
+
+		if mediaType == string(media.JpgMedia) || mediaType == string(media.RafMedia) {
+			name := strings.ToUpper(strings.TrimSuffix(filepath.Base(f.GetPath()), filepath.Ext(f.GetPath())))
+			key := day.Format("2006-01-02") + "/" + name
+			pairs[key] = append(pairs[key], f)
+		}
+	}
+
+	for _, group := range pairs {
+		hasRaw := slices.ContainsFunc(group, func(f media.File) bool { return isMediaType(f, media.RafMedia) })
+		hasJpg := slices.ContainsFunc(group, func(f media.File) bool { return isMediaType(f, media.JpgMedia) })
+		if hasRaw != hasJpg {
+			for _, f := range group {
+				stats.Unpaired = append(stats.Unpaired, f.GetPath())
+			}
+		}
+	}
+	slices.Sort(stats.Unpaired)
+
+	stats.Years = sortedGroups(years, byKey)
+	stats.Months = sortedGroups(months, byKey)
+	stats.MediaTypes = sortedGroups(mediaTypes, byBytes)
+	stats.Cameras = sortedGroups(cameras, byBytes)
+	stats.Lenses = sortedGroups(lenses, byBytes)
+	stats.LargestDays = sortedGroups(days, byBytes)
+	if largest := max(options.LargestDays, 0); len(stats.LargestDays) > largest {
+		stats.LargestDays = stats.LargestDays[:largest]
+	}
+
+	events.emit(Event{Type: EventStats, Message: "Library Statistics", Path: options.Destination, Stats: &stats})
+	return stats, nil
+}
+
+func (t Tally) add(size int64) Tally {
+	return Tally{Files: t.Files + 1, Bytes: t.Bytes + size}
+}
+
+func isMediaType(f media.File, mediaType media.MediaType) bool {
+	return strings.EqualFold(filepath.Ext(f.GetPath()), "."+string(mediaType))
+}
+
+// Orders groups by key, for the ones that follow each other like years.
+func byKey(a, b StatsGroup) int {
+	return strings.Compare(a.Key, b.Key)
+}
+
+// Orders groups by size, largest first.
+func byBytes(a, b StatsGroup) int {
+	return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Key, b.Key))
+}
+
+func sortedGroups(tallies map[string]Tally, order func(a, b StatsGroup) int) []StatsGroup {
+	groups := make([]StatsGroup, 0, len(tallies))
+	for key, tally := range tallies {
+		groups = append(groups, StatsGroup{Key: key, Tally: tally})
+	}
+	slices.SortFunc(groups, order)
+	return groups
+}
@@ -0,0 +1,97 @@
+package workflow
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/andrius-ordojan/shutter-pilot/storage"
+)
+
+// Limits how hard the disks are worked while source and destination
+// directories are scanned.
+type ScanLimits struct {
+	// Directories listed at the same time
+	ScanWorkers int
+	// Files read at the same time to fingerprint them. Zero means twice the
+	// number of CPUs.
+	HashWorkers int
+	// Worker limits for single roots, used for both listing and reading
+	RootWorkers map[string]int
+	// Bytes read per second across all workers. Zero means no limit.
+	BytesPerSecond int64
+}
+
+// Returns the number of listing and reading workers for the root directory.
+func (l ScanLimits) forRoot(root string) (scanWorkers, hashWorkers int) {
+	scanWorkers = max(l.ScanWorkers, 1)
+	hashWorkers = l.HashWorkers
+	if hashWorkers <= 0 {
+		hashWorkers = runtime.NumCPU() * 2
+	}
+
+	for path, workers := range l.RootWorkers {
+		if sameRoot(path, root) {
+			return workers, workers
+		}
+	}
+	return scanWorkers, hashWorkers
+}
+
+func sameRoot(a, b string) bool {
+	absA, err := storage.Abs(a)
+	if err != nil {
+		return false
+	}
+	absB, err := storage.Abs(b)
+	if err != nil {
+		return false
+	}
+	return absA == absB
+}
+
+// Spreads reads over time so they don't exceed the allowed bandwidth. A nil
+// limiter does not limit anything.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	mu             sync.Mutex
+	// When the bytes reserved so far have been used up
+	next time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Reserves n bytes and waits until they may be read.
+func (l *bandwidthLimiter) take(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.bytesPerSecond) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
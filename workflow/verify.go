@@ -0,0 +1,96 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Number of files checked by a verify run.
+type VerifySummary struct {
+	Verified int `json:"verified"`
+	Damaged  int `json:"damaged"`
+	Missing  int `json:"missing"`
+}
+
+// Fingerprints the files the runs recorded in the journals of the destination
+// placed there again, and compares them with the fingerprints they were placed
+// with. Files that were moved on by a later run are looked for where they were
+// moved to. Files placed before journals were kept have nothing to be compared
+// with and are not checked. Of the options only the destination, the file
+// system and the event sink are used.
+func Verify(ctx context.Context, options Options) (_ VerifySummary, err error) {
+	events := newEmitter(options.Events)
+	defer func() { events.failed(err) }()
+
+	fsys := fileSystem(options.FS)
+	dir := filepath.Join(options.Destination, stateDirName, journalDirName)
+	dirEntries, err := fsys.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return VerifySummary{}, fmt.Errorf("no journals to verify against in %s", options.Destination)
+		}
+		return VerifySummary{}, fmt.Errorf("failed to read journals: %w", err)
+	}
+
+	var entries []journalEntry
+	for _, e := range dirEntries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".jsonl" {
+			continue
+		}
+
+		journalEntries, err := readJournal(fsys, filepath.Join(dir, e.Name()))
+		if err != nil {
+			return VerifySummary{}, fmt.Errorf("failed to read journal %s: %w", e.Name(), err)
+		}
+		entries = append(entries, journalEntries...)
+	}
+	// Replayed in the order the changes were made, so later runs win
+	slices.SortStableFunc(entries, func(a, b journalEntry) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	fingerprints := make(map[string]string)
+	for _, e := range entries {
+		if e.Action == ActionMove || e.Action == ActionQuarantine {
+			delete(fingerprints, e.Source)
+		}
+		fingerprints[e.Destination] = e.Fingerprint
+	}
+
+	paths := make([]string, 0, len(fingerprints))
+	for path := range fingerprints {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	events.emit(Event{Type: EventVerifying, Message: fmt.Sprintf("Verifying %s:", options.Destination), Path: options.Destination})
+	var summary VerifySummary
+
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return summary, ctx.Err()
+		default:
+		}
+
+		err := checkFingerprint(fsys, path, fingerprints[path])
+		switch {
+		case err == nil:
+			summary.Verified++
+			events.emit(Event{Type: EventVerified, Message: fmt.Sprintf("%s is intact", path), Path: path})
+		case errors.Is(err, os.ErrNotExist):
+			summary.Missing++
+			events.emit(Event{Type: EventVerifyFailed, Message: fmt.Sprintf("%s is missing", path), Path: path, Err: err})
+		default:
+			summary.Damaged++
+			events.emit(Event{Type: EventVerifyFailed, Message: fmt.Sprintf("%s is damaged: %s", path, err), Path: path, Err: err})
+		}
+	}
+
+	events.emit(Event{Type: EventVerifySummary, Message: "Verify Summary", VerifySummary: &summary})
+	return summary, nil
+}
@@ -0,0 +1,183 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// How long a new volume has to show its DCIM directory, the mount point is
+	// created a moment before the card is mounted on it
+	cardSettleTime   = 10 * time.Second
+	cardPollInterval = 500 * time.Millisecond
+)
+
+// Names of the directory cameras keep their media in at the root of a card.
+var dcimNames = []string{"DCIM", "dcim"}
+
+// Returned by the import of a card that was not imported on purpose, e.g. when
+// applying the plan was declined.
+var ErrCardSkipped = errors.New("card skipped")
+
+// Volume that appeared in a mount directory, with the DCIM directory of the
+// card when it is one.
+type mountedVolume struct {
+	path string
+	dcim string
+}
+
+// Calls importCard with the DCIM directory of every card that is mounted in one
+// of the mount directories while watching, one card at a time. Cards that are
+// mounted already are left alone and volumes without a DCIM directory are
+// ignored. A mount directory that doesn't exist yet is watched for until it is
+// created. A failed import is reported and watching goes on until the context
+// is cancelled.
+func WatchCards(ctx context.Context, mountDirs []string, sink EventSink, importCard func(ctx context.Context, dcim string) error) error {
+	events := newEmitter(sink)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watching for cards: %w", err)
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool)
+	// Mount directories that are yet to be created
+	pending := make(map[string]bool)
+	for _, dir := range mountDirs {
+		dir = filepath.Clean(dir)
+
+		ok, err := watchClosest(watcher, dir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			pending[dir] = true
+			events.emit(Event{Type: EventWatching, Message: fmt.Sprintf("Waiting for %s to be created", dir), Path: dir})
+			continue
+		}
+		watched[dir] = true
+		events.emit(Event{Type: EventWatching, Message: fmt.Sprintf("Watching %s for cards", dir), Path: dir})
+	}
+
+	volumes := make(chan mountedVolume)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return fmt.Errorf("failed to watch for cards: %w", err)
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !e.Has(fsnotify.Create) {
+				continue
+			}
+
+			if watched[filepath.Dir(e.Name)] {
+				go waitForCard(ctx, e.Name, volumes)
+			}
+
+			for dir := range pending {
+				if dir != e.Name && !strings.HasPrefix(dir, e.Name+string(filepath.Separator)) {
+					continue
+				}
+
+				ok, err := watchClosest(watcher, dir)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				delete(pending, dir)
+				watched[dir] = true
+				events.emit(Event{Type: EventWatching, Message: fmt.Sprintf("Watching %s for cards", dir), Path: dir})
+
+				// The directory is created for the first volume that is mounted,
+				// which can be in it before it is watched
+				entries, _ := os.ReadDir(dir)
+				for _, entry := range entries {
+					go waitForCard(ctx, filepath.Join(dir, entry.Name()), volumes)
+				}
+			}
+		case v := <-volumes:
+			if v.dcim == "" {
+				events.emit(Event{Type: EventCardIgnored, Message: fmt.Sprintf("Ignoring %s, it has no DCIM directory", v.path), Path: v.path})
+				continue
+			}
+
+			events.emit(Event{Type: EventCardMounted, Message: fmt.Sprintf("Card mounted at %s", v.path), Path: v.dcim})
+			err := importCard(ctx, v.dcim)
+			switch {
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case errors.Is(err, ErrCardSkipped):
+				events.emit(Event{Type: EventCardSkipped, Message: fmt.Sprintf("Skipped card %s", v.path), Path: v.dcim})
+			case errors.Is(err, ErrBlocked):
+				events.emit(Event{Type: EventCardSkipped, Message: fmt.Sprintf("Nothing imported from card %s, its plan is blocked", v.path), Path: v.dcim, Err: err})
+			case err != nil:
+				events.emit(Event{Type: EventCardFailed, Message: fmt.Sprintf("Import of card %s failed: %v", v.path, err), Path: v.dcim, Err: err})
+			default:
+				events.emit(Event{Type: EventCardImported, Message: fmt.Sprintf("Imported card %s", v.path), Path: v.dcim})
+			}
+		}
+	}
+}
+
+// Watches the directory when it exists, otherwise the closest parent of it that
+// does so its creation is noticed. Reports whether the directory itself is
+// watched.
+func watchClosest(watcher *fsnotify.Watcher, dir string) (bool, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		err := watcher.Add(d)
+		if err == nil {
+			return d == dir, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(d) == d {
+			return false, fmt.Errorf("failed to watch %s: %w", d, err)
+		}
+	}
+}
+
+// Waits for the DCIM directory of the volume to show up once it is mounted.
+func waitForCard(ctx context.Context, volume string, found chan<- mountedVolume) {
+	v := mountedVolume{path: volume}
+	deadline := time.Now().Add(cardSettleTime)
+
+	for v.dcim == "" && time.Now().Before(deadline) {
+		for _, name := range dcimNames {
+			dcim := filepath.Join(volume, name)
+			if info, err := os.Stat(dcim); err == nil && info.IsDir() {
+				v.dcim = dcim
+				break
+			}
+		}
+		if v.dcim != "" {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cardPollInterval):
+		}
+	}
+
+	select {
+	case found <- v:
+	case <-ctx.Done():
+	}
+}